@@ -0,0 +1,219 @@
+package main
+
+import (
+	"btc/internal/torrent"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// infoFile is a file entry of the info subcommand output
+type infoFile struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+// infoOutput is everything the info subcommand reports, shared by the text
+// and JSON renderers. Fields a magnet link cannot provide are left empty.
+type infoOutput struct {
+	Name           string     `json:"name"`
+	InfoHash       string     `json:"info_hash,omitempty"`
+	InfoHashBase32 string     `json:"info_hash_base32,omitempty"`
+	InfoHashV2     string     `json:"info_hash_v2,omitempty"`
+	MetaVersion    int        `json:"meta_version,omitempty"`
+	PieceLength    int        `json:"piece_length,omitempty"`
+	Pieces         int        `json:"pieces,omitempty"`
+	TotalSize      int64      `json:"total_size"`
+	Files          []infoFile `json:"files,omitempty"`
+	Trackers       [][]string `json:"trackers"`
+	WebSeeds       []string   `json:"web_seeds,omitempty"`
+	Private        bool       `json:"private"`
+	CreatedBy      string     `json:"created_by,omitempty"`
+	CreationDate   *time.Time `json:"creation_date,omitempty"`
+	Comment        string     `json:"comment,omitempty"`
+}
+
+// runInfo implements `bitorrent info <file|magnet>`
+func runInfo(args []string) int {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print machine readable JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s info [--json] <torrent-file|magnet-link>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+
+	out, err := loadInfo(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(out)
+	} else {
+		err = printInfo(os.Stdout, out)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func loadInfo(source string) (*infoOutput, error) {
+	if strings.HasPrefix(source, "magnet:") {
+		m, err := torrent.ParseMagnet(source)
+		if err != nil {
+			return nil, err
+		}
+		out := &infoOutput{Name: m.Name, TotalSize: m.Length, WebSeeds: m.WebSeeds}
+		if m.HasV1 {
+			out.InfoHash = hex.EncodeToString(m.InfoHash[:])
+			out.InfoHashBase32 = base32.StdEncoding.EncodeToString(m.InfoHash[:])
+		}
+		if m.HasV2 {
+			out.InfoHashV2 = hex.EncodeToString(m.InfoHashV2[:])
+		}
+		// A magnet link has no tiers, each tracker is its own
+		for _, tr := range m.Trackers {
+			out.Trackers = append(out.Trackers, []string{tr})
+		}
+		return out, nil
+	}
+
+	tf, err := torrent.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	out := &infoOutput{
+		Name:           tf.Name,
+		InfoHash:       hex.EncodeToString(tf.InfoHash[:]),
+		InfoHashBase32: base32.StdEncoding.EncodeToString(tf.InfoHash[:]),
+		MetaVersion:    tf.MetaVersion,
+		PieceLength:    tf.PieceLength,
+		Pieces:         tf.NumPieces(),
+		TotalSize:      int64(tf.Length),
+		Trackers:       tf.Trackers(),
+		WebSeeds:       slices.Concat(tf.WebSeeds, tf.HTTPSeeds),
+		Private:        tf.Private,
+		CreatedBy:      tf.CreatedBy,
+		Comment:        tf.Comment,
+	}
+	if tf.MetaVersion == 2 {
+		out.InfoHashV2 = hex.EncodeToString(tf.InfoHashV2[:])
+	}
+	if !tf.CreationDate.IsZero() {
+		out.CreationDate = &tf.CreationDate
+	}
+	for _, f := range tf.Files {
+		if !f.Pad {
+			out.Files = append(out.Files, infoFile{Path: f.Path, Length: int64(f.Length)})
+		}
+	}
+	return out, nil
+}
+
+// printInfo renders the human readable form
+func printInfo(w io.Writer, out *infoOutput) error {
+	var b strings.Builder
+	field := func(name, format string, args ...any) {
+		fmt.Fprintf(&b, "%-15s "+format+"\n", append([]any{name + ":"}, args...)...)
+	}
+
+	field("Name", "%s", out.Name)
+	if out.InfoHash != "" {
+		field("Info hash", "%s", out.InfoHash)
+		field("Base32", "%s", out.InfoHashBase32)
+	}
+	if out.InfoHashV2 != "" {
+		field("Info hash v2", "%s", out.InfoHashV2)
+	}
+	if out.MetaVersion != 0 {
+		field("Meta version", "%d", out.MetaVersion)
+	}
+	if out.PieceLength != 0 {
+		field("Piece length", "%s", formatSize(int64(out.PieceLength)))
+		field("Pieces", "%d", out.Pieces)
+	}
+	field("Total size", "%s (%d bytes)", formatSize(out.TotalSize), out.TotalSize)
+	field("Private", "%t", out.Private)
+	if out.CreatedBy != "" {
+		field("Created by", "%s", out.CreatedBy)
+	}
+	if out.CreationDate != nil {
+		field("Created on", "%s", out.CreationDate.UTC().Format(time.RFC3339))
+	}
+	if out.Comment != "" {
+		field("Comment", "%s", out.Comment)
+	}
+
+	if len(out.Trackers) > 0 {
+		b.WriteString("Trackers:\n")
+		for i, tier := range out.Trackers {
+			fmt.Fprintf(&b, "  tier %d:\n", i+1)
+			for _, tr := range tier {
+				fmt.Fprintf(&b, "    %s\n", tr)
+			}
+		}
+	}
+	if len(out.WebSeeds) > 0 {
+		b.WriteString("Web seeds:\n")
+		for _, ws := range out.WebSeeds {
+			fmt.Fprintf(&b, "  %s\n", ws)
+		}
+	}
+	if len(out.Files) > 0 {
+		b.WriteString("Files:\n")
+		printFileTree(&b, out.Files)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// printFileTree prints files indented under their directories, in torrent order
+func printFileTree(b *strings.Builder, files []infoFile) {
+	var prevDirs []string
+	for _, f := range files {
+		parts := strings.Split(f.Path, "/")
+		dirs := parts[:len(parts)-1]
+
+		common := 0
+		for common < len(dirs) && common < len(prevDirs) && dirs[common] == prevDirs[common] {
+			common++
+		}
+		for depth := common; depth < len(dirs); depth++ {
+			fmt.Fprintf(b, "  %s%s/\n", strings.Repeat("  ", depth), dirs[depth])
+		}
+		fmt.Fprintf(b, "  %s%s (%s)\n", strings.Repeat("  ", len(dirs)), parts[len(parts)-1], formatSize(f.Length))
+		prevDirs = dirs
+	}
+}
+
+// formatSize renders a byte count with a binary unit
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
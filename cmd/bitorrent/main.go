@@ -2,15 +2,36 @@ package main
 
 import (
 	"btc/internal/config"
+	"btc/internal/ipfilter"
+	"btc/internal/listener"
 	"btc/internal/logger"
+	"btc/internal/lsd"
+	"btc/internal/proxy"
+	"btc/internal/stream"
 	"btc/internal/torrent"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
+// patternList is a repeatable flag collecting glob patterns
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
 func main() {
 	// Initialize logger (empty string = stderr, or provide path for file logging)
 	if err := logger.Init(""); err != nil {
@@ -18,6 +39,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "info":
+			os.Exit(runInfo(os.Args[2:]))
+		case "scrape":
+			os.Exit(runScrape(os.Args[2:]))
+		}
+	}
+
 	// Context for cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -32,15 +63,48 @@ func main() {
 		cancel()
 	}()
 
+	cfg := config.Default()
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	serveAddr := flags.String("serve", "", "serve torrent files over HTTP on this address while downloading")
+	flags.BoolVar(&cfg.Sequential, "sequential", cfg.Sequential, "download pieces in order")
+	flags.BoolVar(&cfg.EnableLSD, "lsd", cfg.EnableLSD, "find peers on the local network (BEP 14)")
+	port := flags.Uint("port", uint(cfg.ListenPort), "port to accept peer connections on, 0 for any free port")
+	flags.IntVar(&cfg.NumWant, "numwant", cfg.NumWant, "number of peers to ask trackers for")
+	flags.StringVar(&cfg.ProxyURL, "proxy", "", "connect through this proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port")
+	flags.BoolVar(&cfg.ProxyPeers, "proxy-peers", cfg.ProxyPeers, "use the proxy for peer connections")
+	flags.BoolVar(&cfg.ProxyTrackers, "proxy-trackers", cfg.ProxyTrackers, "use the proxy for trackers, UDP trackers need a SOCKS5 proxy")
+	flags.BoolVar(&cfg.ProxyWebSeeds, "proxy-webseeds", cfg.ProxyWebSeeds, "use the proxy for web seeds")
+	flags.StringVar(&cfg.IPFilter, "ipfilter", "", "blocklist of peer addresses to avoid, reloaded on SIGHUP")
+	var only, exclude patternList
+	flags.Var(&only, "only", "only download files matching this glob (repeatable)")
+	flags.Var(&exclude, "exclude", "skip files matching this glob (repeatable)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <torrent-file> <output-path>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s info [--json] <torrent-file|magnet-link>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s scrape [--json] <torrent-file|magnet-link>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	if *port > 65535 {
+		fmt.Fprintf(os.Stderr, "invalid port %d\n", *port)
+		os.Exit(1)
+	}
+	cfg.ListenPort = uint16(*port)
+	if cfg.ProxyURL != "" {
+		if _, err := proxy.Parse(cfg.ProxyURL); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Validate arguments
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <torrent-file> <output-path>\n", os.Args[0])
+	if flags.NArg() < 2 {
+		flags.Usage()
 		os.Exit(1)
 	}
 
-	cfg := config.Default()
-	inPath := os.Args[1]
-	outPath := os.Args[2]
+	inPath := flags.Arg(0)
+	outPath := flags.Arg(1)
 
 	// Parse torrent file
 	tf, err := torrent.Open(inPath)
@@ -49,7 +113,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	logger.Info("torrent loaded", "name", tf.Name, "size", tf.Length, "pieces", len(tf.PieceHashes))
+	logger.Info("torrent loaded", "name", tf.Name, "size", tf.Length, "pieces", tf.NumPieces(), "version", tf.MetaVersion)
 
 	// Set up download options with progress callback
 	opts := &torrent.DownloadOptions{
@@ -60,10 +124,48 @@ func main() {
 		OnEvent: func(event string, data map[string]any) {
 			logger.Debug("event", "type", event, "data", data)
 		},
+		Only:    only,
+		Exclude: exclude,
+	}
+	if cfg.IPFilter != "" {
+		filter, err := ipfilter.Load(cfg.IPFilter)
+		if err != nil {
+			logger.Error("failed to load IP filter", "error", err)
+			os.Exit(1)
+		}
+		go reloadOnHangup(ctx, filter)
+		opts.IPFilter = filter
+	}
+	// Trackers and LSD are told the port we actually listen on
+	ln, err := listener.New(cfg.ListenPort, cfg)
+	if err != nil && cfg.ListenPort != 0 {
+		logger.Warn("port unavailable, listening on another one", "port", cfg.ListenPort, "error", err)
+		ln, err = listener.New(0, cfg)
+	}
+	if err != nil {
+		logger.Error("failed to accept peer connections", "error", err)
+		os.Exit(1)
+	}
+	cfg.ListenPort = ln.Port()
+	go ln.Run(ctx)
+	opts.Listener = ln
+
+	if cfg.EnableLSD && !tf.Private {
+		service, err := lsd.New(int(cfg.ListenPort))
+		if err != nil {
+			logger.Warn("local service discovery unavailable", "error", err)
+		} else {
+			go service.Run(ctx)
+			opts.LSD = service
+		}
 	}
 
 	// Download
-	err = tf.DownloadToFile(ctx, outPath, cfg, opts)
+	if *serveAddr != "" {
+		err = downloadAndServe(ctx, tf, outPath, *serveAddr, cfg, opts)
+	} else {
+		err = tf.DownloadToFile(ctx, outPath, cfg, opts)
+	}
 	if err != nil {
 		if ctx.Err() != nil {
 			logger.Info("download interrupted")
@@ -76,3 +178,53 @@ func main() {
 	fmt.Println() // New line after progress
 	logger.Info("download complete", "output", outPath)
 }
+
+// reloadOnHangup reloads the IP filter whenever the process gets SIGHUP
+func reloadOnHangup(ctx context.Context, filter *ipfilter.Filter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := filter.Reload(); err != nil {
+				logger.Warn("failed to reload IP filter, keeping the old one", "error", err)
+			}
+		}
+	}
+}
+
+// downloadAndServe downloads the torrent while serving its files over HTTP,
+// and keeps serving after completion until ctx is cancelled. Skipped files
+// are fetched when they are read.
+func downloadAndServe(ctx context.Context, tf *torrent.TorrentFile, outPath, addr string, cfg *config.Config, opts *torrent.DownloadOptions) error {
+	t, err := tf.Prepare(outPath, cfg, opts)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	go tf.WatchSwarm(ctx, cfg, t)
+
+	srv := &http.Server{Addr: addr, Handler: stream.NewServer(t)}
+	go func() {
+		logger.Info("serving torrent over HTTP", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server failed", "error", err)
+		}
+	}()
+	defer srv.Close()
+
+	// Download runs while a reader is open, so holding one until we stop
+	// serving lets skipped files be streamed after the selection completes
+	keep, err := t.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer keep.Close()
+	if err := t.Download(ctx, outPath); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
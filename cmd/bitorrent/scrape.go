@@ -0,0 +1,118 @@
+package main
+
+import (
+	"btc/internal/config"
+	"btc/internal/proxy"
+	"btc/internal/torrent"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// scrapeTracker is one tracker's answer in the scrape subcommand output
+type scrapeTracker struct {
+	URL        string `json:"url"`
+	Seeders    int    `json:"seeders"`
+	Leechers   int    `json:"leechers"`
+	Downloaded int    `json:"downloaded"`
+	Error      string `json:"error,omitempty"`
+}
+
+// scrapeOutput is the swarm health of one torrent
+type scrapeOutput struct {
+	Name     string          `json:"name"`
+	InfoHash string          `json:"info_hash"`
+	Trackers []scrapeTracker `json:"trackers"`
+}
+
+// runScrape implements `bitorrent scrape <file|magnet>...`. Torrents sharing
+// a tracker are scraped in a single request.
+func runScrape(args []string) int {
+	flags := flag.NewFlagSet("scrape", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print machine readable JSON")
+	cfg := config.Default()
+	flags.StringVar(&cfg.ProxyURL, "proxy", "", "contact trackers through this socks5:// or http:// proxy")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s scrape [--json] [--proxy url] <torrent-file|magnet-link>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+	if cfg.ProxyURL != "" {
+		if _, err := proxy.Parse(cfg.ProxyURL); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+	}
+
+	var outputs []*scrapeOutput
+	var hashes [][20]byte
+	requests := make(map[string][][20]byte)
+	for _, source := range flags.Args() {
+		info, err := loadInfo(source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", source, err)
+			return 1
+		}
+		raw, err := hex.DecodeString(info.InfoHash)
+		if err != nil || len(raw) != 20 {
+			fmt.Fprintf(os.Stderr, "error: %s: no v1 info hash to scrape\n", source)
+			return 1
+		}
+		hash := [20]byte(raw)
+		outputs = append(outputs, &scrapeOutput{Name: info.Name, InfoHash: info.InfoHash})
+		hashes = append(hashes, hash)
+		for _, tier := range info.Trackers {
+			for _, announce := range tier {
+				requests[announce] = append(requests[announce], hash)
+			}
+		}
+	}
+
+	for _, res := range torrent.ScrapeTrackers(cfg, requests) {
+		for i, out := range outputs {
+			if !slices.Contains(requests[res.Tracker], hashes[i]) {
+				continue
+			}
+			entry := scrapeTracker{URL: res.Tracker}
+			if res.Err != nil {
+				entry.Error = res.Err.Error()
+			} else if s, ok := res.Stats[hashes[i]]; ok {
+				entry.Seeders, entry.Leechers, entry.Downloaded = s.Seeders, s.Leechers, s.Downloaded
+			} else {
+				entry.Error = "torrent not known to tracker"
+			}
+			out.Trackers = append(out.Trackers, entry)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(outputs); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	for _, out := range outputs {
+		fmt.Printf("%s (%s)\n", out.Name, out.InfoHash)
+		if len(out.Trackers) == 0 {
+			fmt.Println("  no trackers")
+		}
+		for _, tr := range out.Trackers {
+			if tr.Error != "" {
+				fmt.Printf("  %s: %s\n", tr.URL, tr.Error)
+				continue
+			}
+			fmt.Printf("  %s: %d seeders, %d leechers, %d downloaded\n", tr.URL, tr.Seeders, tr.Leechers, tr.Downloaded)
+		}
+	}
+	return 0
+}
@@ -2,7 +2,4 @@ module btc
 
 go 1.23.2
 
-require (
-	github.com/gammazero/deque v1.2.0
-	github.com/jackpal/bencode-go v1.0.2
-)
+require github.com/gammazero/deque v1.2.0
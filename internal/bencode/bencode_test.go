@@ -0,0 +1,278 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"unknown type", "x"},
+		{"unterminated integer", "i42"},
+		{"empty integer", "ie"},
+		{"plus sign", "i+1e"},
+		{"not a number", "i1x2e"},
+		{"integer too long", "i123456789012345678901234e"},
+		{"integer overflow", "i9223372036854775808e"},
+		{"truncated string", "5:abc"},
+		{"negative length", "-1:a"},
+		{"missing colon", "3abc"},
+		{"unterminated list", "li1e"},
+		{"unterminated dict", "d1:ai1e"},
+		{"dict missing value", "d1:ae"},
+		{"non-string key", "di1ei2ee"},
+		{"trailing data", "i1ei2e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			err := Unmarshal([]byte(tt.input), &v)
+			var syntax *SyntaxError
+			if !errors.As(err, &syntax) {
+				t.Fatalf("Unmarshal(%q) = %v, want a SyntaxError", tt.input, err)
+			}
+		})
+	}
+}
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"leading zero", "i03e"},
+		{"negative leading zero", "i-03e"},
+		{"negative zero", "i-0e"},
+		{"leading zero length", "03:abc"},
+		{"unsorted keys", "d1:bi1e1:ai2ee"},
+		{"duplicate keys", "d1:ai1e1:ai2ee"},
+		{"unsorted nested keys", "d1:ad1:zi0e1:yi0eee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Accepted unless strict
+			var v any
+			if err := Unmarshal([]byte(tt.input), &v); err != nil {
+				t.Fatalf("lenient decode of %q failed: %v", tt.input, err)
+			}
+			d := NewDecoder(strings.NewReader(tt.input))
+			d.SetStrict(true)
+			var syntax *SyntaxError
+			if err := d.Decode(&v); !errors.As(err, &syntax) {
+				t.Fatalf("strict decode of %q = %v, want a SyntaxError", tt.input, err)
+			}
+		})
+	}
+
+	d := NewDecoder(strings.NewReader("d1:ai0e1:bi-1e2:bbi10ee"))
+	d.SetStrict(true)
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Errorf("strict decode of canonical input failed: %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		depth    int
+		strLen   int64
+		wantFail bool
+	}{
+		{"depth within limit", "llleee", 2, 10, false},
+		{"depth over limit", "lllleeee", 2, 10, true},
+		{"dict depth over limit", "d1:ad1:ad1:ai0eeee", 1, 10, true},
+		{"string within limit", "5:abcde", 2, 5, false},
+		{"string over limit", "6:abcdef", 2, 5, true},
+		{"key over limit", "d6:abcdefi0ee", 2, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tt.input))
+			d.SetLimits(tt.depth, tt.strLen)
+			var v any
+			err := d.Decode(&v)
+			if tt.wantFail != (err != nil) {
+				t.Fatalf("Decode(%q) = %v, want failure %v", tt.input, err, tt.wantFail)
+			}
+		})
+	}
+}
+
+func TestDeclaredLengthAllocation(t *testing.T) {
+	// 12 bytes claiming a string just under the default limit
+	input := []byte("268435455:ab")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var v any
+	err := Unmarshal(input, &v)
+	runtime.ReadMemStats(&after)
+
+	var syntax *SyntaxError
+	if !errors.As(err, &syntax) {
+		t.Fatalf("Unmarshal = %v, want a SyntaxError", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("decoding a truncated string allocated %d bytes", allocated)
+	}
+}
+
+func TestLongString(t *testing.T) {
+	// Longer than one read chunk
+	s := strings.Repeat("0123456789", 20000)
+	var got string
+	if err := Unmarshal([]byte("200000:"+s), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != s {
+		t.Error("long string changed in decoding")
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e3:abcle"))
+	var values []any
+	for {
+		var v any
+		err := d.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, v)
+	}
+	want := []any{int64(1), "abc", []any{}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("decoded %v, want %v", values, want)
+	}
+	if d.InputOffset() != 10 {
+		t.Errorf("InputOffset = %d, want 10", d.InputOffset())
+	}
+}
+
+func TestErrorOffset(t *testing.T) {
+	var v any
+	err := Unmarshal([]byte("li1ei2ex"), &v)
+	var syntax *SyntaxError
+	if !errors.As(err, &syntax) || syntax.Offset != 7 {
+		t.Errorf("Unmarshal = %v, want a SyntaxError at offset 7", err)
+	}
+
+	var n struct {
+		A string `bencode:"a"`
+	}
+	err = Unmarshal([]byte("d1:ai5ee"), &n)
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Offset != 4 {
+		t.Errorf("Unmarshal = %v, want an UnmarshalTypeError at offset 4", err)
+	}
+}
+
+type inner struct {
+	Hash [4]byte `bencode:"hash"`
+	Tags []string
+}
+
+type outer struct {
+	Name     string         `bencode:"name"`
+	Size     int64          `bencode:"size"`
+	Port     uint16         `bencode:"port,omitempty"`
+	Private  bool           `bencode:"private,omitempty"`
+	Data     []byte         `bencode:"data"`
+	Inner    inner          `bencode:"inner"`
+	List     []inner        `bencode:"list"`
+	Raw      RawMessage     `bencode:"raw"`
+	Dict     map[string]int `bencode:"dict"`
+	Any      any            `bencode:"any"`
+	Skipped  string         `bencode:"-"`
+	Extra    map[string]any `bencode:",extra"`
+	internal int
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := outer{
+		Name:    "x",
+		Size:    -5,
+		Private: true,
+		Data:    []byte{0, 1, 2},
+		Inner:   inner{Hash: [4]byte{1, 2, 3, 4}, Tags: []string{"a", "b"}},
+		List:    []inner{{Tags: []string{"c"}}},
+		Raw:     RawMessage("d1:xi1ee"),
+		Dict:    map[string]int{"b": 2, "a": 1},
+		Any:     []any{int64(1), "s", map[string]any{"k": "v"}},
+		Extra:   map[string]any{"zz": "last", "aa": int64(7)},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Canonical output passes strict decoding
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetStrict(true)
+	var out outer
+	if err := d.Decode(&out); err != nil {
+		t.Fatalf("decoding %q: %v", data, err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip of %q\ngot  %+v\nwant %+v", data, out, in)
+	}
+
+	again, err := Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Errorf("re-encoded as %q, want %q", again, data)
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	input := "d4:infod1:ai1e1:bl1:xee4:namei3ee"
+	var v struct {
+		Info RawMessage `bencode:"info"`
+		Name int        `bencode:"name"`
+	}
+	if err := Unmarshal([]byte(input), &v); err != nil {
+		t.Fatal(err)
+	}
+	if string(v.Info) != "d1:ai1e1:bl1:xee" || v.Name != 3 {
+		t.Errorf("got info %q and name %d", v.Info, v.Name)
+	}
+}
+
+func TestExtraKeepsUnknownKeys(t *testing.T) {
+	var v struct {
+		Name  string         `bencode:"name"`
+		Extra map[string]any `bencode:",extra"`
+	}
+	if err := Unmarshal([]byte("d1:ai1e4:name1:x1:zl1:yee"), &v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"a": int64(1), "z": []any{"y"}}
+	if v.Name != "x" || !reflect.DeepEqual(v.Extra, want) {
+		t.Errorf("got name %q and extra %v, want extra %v", v.Name, v.Extra, want)
+	}
+
+	// A field's key is never written from the extra map
+	v.Extra["name"] = "shadowed"
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d1:ai1e4:name1:x1:zl1:yee" {
+		t.Errorf("encoded %q", data)
+	}
+}
@@ -0,0 +1,499 @@
+// Package bencode implements the bencoding used by torrent files, tracker
+// responses and extension messages.
+//
+// Values decode into structs (using `bencode:"key,omitempty"` tags), maps
+// with string keys, slices, strings, byte slices and arrays, integers and
+// booleans. Into an empty interface, integers decode as int64, strings as
+// string, lists as []any and dictionaries as map[string]any. RawMessage
+// captures the exact encoded bytes of a value. A struct's map field tagged
+// `bencode:",extra"` keeps the dictionary entries no other field takes.
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// Default decoding limits, see Decoder.SetLimits
+const (
+	DefaultMaxDepth        = 256
+	DefaultMaxStringLength = 256 << 20
+)
+
+// stringChunk bounds how much of a string is allocated before its bytes
+// arrive, so a large declared length cannot allocate more than the input
+const stringChunk = 64 << 10
+
+// RawMessage is a raw encoded value. It is filled verbatim when decoding
+// and written verbatim when encoding.
+type RawMessage []byte
+
+// SyntaxError reports malformed input and where it was found
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// UnmarshalTypeError reports a value that cannot be stored in the target type
+type UnmarshalTypeError struct {
+	Value  string
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot decode %s into %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// Decoder reads bencoded values from a stream
+type Decoder struct {
+	r         *bufio.Reader
+	off       int64
+	strict    bool
+	maxDepth  int
+	maxStrLen int64
+	// rec collects the bytes read while capturing a RawMessage
+	rec       []byte
+	recording bool
+}
+
+// NewDecoder returns a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:         bufio.NewReader(r),
+		maxDepth:  DefaultMaxDepth,
+		maxStrLen: DefaultMaxStringLength,
+	}
+}
+
+// SetStrict makes the decoder reject non-canonical input: unsorted or
+// duplicate dictionary keys, leading zeros and negative zero.
+func (d *Decoder) SetStrict(strict bool) {
+	d.strict = strict
+}
+
+// SetLimits bounds the nesting depth and the length of any single string
+func (d *Decoder) SetLimits(maxDepth int, maxStringLength int64) {
+	d.maxDepth = maxDepth
+	d.maxStrLen = maxStringLength
+}
+
+// InputOffset returns the number of bytes consumed so far
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// Unmarshal decodes exactly one value from data into v
+func Unmarshal(data []byte, v any) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(v); err != nil {
+		if err == io.EOF {
+			return d.syntaxError("unexpected end of input")
+		}
+		return err
+	}
+	if d.off != int64(len(data)) {
+		return d.syntaxError("trailing data after value")
+	}
+	return nil
+}
+
+// Decode reads the next value from the stream into v, which must be a
+// non-nil pointer.
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: Decode needs a non-nil pointer, got %T", v)
+	}
+	// A clean end of stream between values is reported as io.EOF
+	if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+	return d.value(rv.Elem(), 0)
+}
+
+func (d *Decoder) syntaxError(format string, args ...any) error {
+	return &SyntaxError{Offset: d.off, msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, d.syntaxError("unexpected end of input")
+		}
+		return 0, err
+	}
+	d.off++
+	if d.recording {
+		d.rec = append(d.rec, c)
+	}
+	return c, nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, d.syntaxError("unexpected end of input")
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readInt reads digits up to the terminator, checking canonical form
+func (d *Decoder) readInt(term byte) (int64, error) {
+	start := d.off
+	var digits []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == term {
+			break
+		}
+		if len(digits) > 20 {
+			return 0, &SyntaxError{Offset: start, msg: "integer too long"}
+		}
+		digits = append(digits, c)
+	}
+
+	s := string(digits)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || s == "" || s[0] == '+' {
+		return 0, &SyntaxError{Offset: start, msg: fmt.Sprintf("invalid integer %q", s)}
+	}
+	if d.strict && (s == "-0" || (len(s) > 1 && s[0] == '0') || (len(s) > 2 && s[:2] == "-0")) {
+		return 0, &SyntaxError{Offset: start, msg: fmt.Sprintf("non-canonical integer %q", s)}
+	}
+	return n, nil
+}
+
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.off
+	n, err := d.readInt(':')
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, &SyntaxError{Offset: start, msg: "negative string length"}
+	}
+	if n > d.maxStrLen {
+		return nil, &SyntaxError{Offset: start, msg: fmt.Sprintf("string length %d exceeds limit %d", n, d.maxStrLen)}
+	}
+
+	// Grow with the data read instead of trusting the declared length
+	buf := make([]byte, 0, min(n, stringChunk))
+	for remaining := n; remaining > 0; {
+		step := int(min(remaining, stringChunk))
+		buf = slices.Grow(buf, step)
+		read, err := io.ReadFull(d.r, buf[len(buf):len(buf)+step])
+		buf = buf[:len(buf)+read]
+		d.off += int64(read)
+		if err != nil {
+			return nil, d.syntaxError("truncated string")
+		}
+		remaining -= int64(step)
+	}
+	if d.recording {
+		d.rec = append(d.rec, buf...)
+	}
+	return buf, nil
+}
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// value decodes the next value into v
+func (d *Decoder) value(v reflect.Value, depth int) error {
+	if depth > d.maxDepth {
+		return d.syntaxError("nesting exceeds depth limit %d", d.maxDepth)
+	}
+
+	if v.Type() == rawMessageType {
+		return d.raw(v, depth)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem(), depth)
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			val, err := d.any(depth)
+			if err != nil {
+				return err
+			}
+			if val != nil {
+				v.Set(reflect.ValueOf(val))
+			}
+			return nil
+		}
+	}
+
+	offset := d.off
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		d.readByte()
+		n, err := d.readInt('e')
+		if err != nil {
+			return err
+		}
+		return setInt(v, n, offset)
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		return setString(v, s, offset)
+	case c == 'l':
+		d.readByte()
+		return d.list(v, depth, offset)
+	case c == 'd':
+		d.readByte()
+		return d.dict(v, depth, offset)
+	default:
+		return d.syntaxError("invalid value type %q", c)
+	}
+}
+
+// raw captures the encoded bytes of the next value
+func (d *Decoder) raw(v reflect.Value, depth int) error {
+	if d.recording {
+		// Already capturing an enclosing value
+		return d.skip(depth)
+	}
+	d.recording = true
+	d.rec = d.rec[:0]
+	err := d.skip(depth)
+	d.recording = false
+	if err != nil {
+		return err
+	}
+	v.SetBytes(append(RawMessage(nil), d.rec...))
+	return nil
+}
+
+// skip consumes the next value without storing it
+func (d *Decoder) skip(depth int) error {
+	_, err := d.any(depth)
+	return err
+}
+
+// any decodes the next value into its generic form
+func (d *Decoder) any(depth int) (any, error) {
+	if depth > d.maxDepth {
+		return nil, d.syntaxError("nesting exceeds depth limit %d", d.maxDepth)
+	}
+
+	c, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		d.readByte()
+		return d.readInt('e')
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		return string(s), err
+	case c == 'l':
+		d.readByte()
+		list := []any{}
+		for {
+			c, err := d.peekByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.readByte()
+				return list, nil
+			}
+			item, err := d.any(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+	case c == 'd':
+		d.readByte()
+		dict := map[string]any{}
+		err := d.keys(func(key string) error {
+			item, err := d.any(depth + 1)
+			dict[key] = item
+			return err
+		})
+		return dict, err
+	default:
+		return nil, d.syntaxError("invalid value type %q", c)
+	}
+}
+
+// keys reads dictionary entries until the end marker, calling fn with each
+// key positioned before its value
+func (d *Decoder) keys(fn func(key string) error) error {
+	var prev []byte
+	first := true
+	for {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			return nil
+		}
+		if c < '0' || c > '9' {
+			return d.syntaxError("dictionary key is not a string")
+		}
+		offset := d.off
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if d.strict && !first && bytes.Compare(prev, key) >= 0 {
+			return &SyntaxError{Offset: offset, msg: fmt.Sprintf("dictionary key %q out of order or duplicated", key)}
+		}
+		prev, first = key, false
+		if err := fn(string(key)); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Decoder) list(v reflect.Value, depth int, offset int64) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		v.Set(v.Slice(0, 0))
+	case reflect.Array:
+	default:
+		return &UnmarshalTypeError{Value: "list", Type: v.Type(), Offset: offset}
+	}
+
+	i := 0
+	for {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			break
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		} else if i >= v.Len() {
+			return &UnmarshalTypeError{Value: "list longer than array", Type: v.Type(), Offset: offset}
+		}
+		if err := d.value(v.Index(i), depth+1); err != nil {
+			return err
+		}
+		i++
+	}
+	if v.Kind() == reflect.Array && i != v.Len() {
+		return &UnmarshalTypeError{Value: "list shorter than array", Type: v.Type(), Offset: offset}
+	}
+	return nil
+}
+
+func (d *Decoder) dict(v reflect.Value, depth int, offset int64) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnmarshalTypeError{Value: "dictionary", Type: v.Type(), Offset: offset}
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		return d.keys(func(key string) error {
+			return d.mapEntry(v, key, depth+1)
+		})
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		return d.keys(func(key string) error {
+			f, ok := fields.byKey[key]
+			switch {
+			case ok:
+				return d.value(v.FieldByIndex(f.index), depth+1)
+			case fields.extra != nil:
+				extra := v.FieldByIndex(fields.extra)
+				if extra.IsNil() {
+					extra.Set(reflect.MakeMap(extra.Type()))
+				}
+				return d.mapEntry(extra, key, depth+1)
+			default:
+				return d.skip(depth + 1)
+			}
+		})
+	default:
+		return &UnmarshalTypeError{Value: "dictionary", Type: v.Type(), Offset: offset}
+	}
+}
+
+// mapEntry decodes the next value and stores it in the map m under key
+func (d *Decoder) mapEntry(m reflect.Value, key string, depth int) error {
+	elem := reflect.New(m.Type().Elem()).Elem()
+	if err := d.value(elem, depth); err != nil {
+		return err
+	}
+	m.SetMapIndex(reflect.ValueOf(key).Convert(m.Type().Key()), elem)
+	return nil
+}
+
+func setInt(v reflect.Value, n int64, offset int64) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			break
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			break
+		}
+		v.SetUint(uint64(n))
+		return nil
+	case reflect.Bool:
+		v.SetBool(n != 0)
+		return nil
+	}
+	return &UnmarshalTypeError{Value: "integer " + strconv.FormatInt(n, 10), Type: v.Type(), Offset: offset}
+}
+
+func setString(v reflect.Value, s []byte, offset int64) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(s))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(s)
+			return nil
+		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(s) {
+			reflect.Copy(v, reflect.ValueOf(s))
+			return nil
+		}
+	}
+	return &UnmarshalTypeError{Value: fmt.Sprintf("string of length %d", len(s)), Type: v.Type(), Offset: offset}
+}
@@ -0,0 +1,175 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Encoder writes bencoded values to a stream
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder returns an encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Marshal returns the bencoding of v
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode writes the bencoding of v. Dictionary keys are written in sorted
+// order so the output is canonical.
+func (e *Encoder) Encode(v any) error {
+	if err := e.value(reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (e *Encoder) writeString(s string) {
+	e.w.WriteString(strconv.Itoa(len(s)))
+	e.w.WriteByte(':')
+	e.w.WriteString(s)
+}
+
+func (e *Encoder) value(v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("bencode: cannot encode nil value")
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("bencode: cannot encode empty RawMessage")
+		}
+		e.w.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: cannot encode nil %s", v.Type())
+		}
+		return e.value(v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(e.w, "i%de", v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fmt.Fprintf(e.w, "i%de", v.Uint())
+	case reflect.Bool:
+		if v.Bool() {
+			e.w.WriteString("i1e")
+		} else {
+			e.w.WriteString("i0e")
+		}
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.writeString(string(b))
+			return nil
+		}
+		e.w.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		e.w.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: map key type %s is not a string", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		e.w.WriteByte('d')
+		for _, k := range keys {
+			elem := v.MapIndex(k)
+			if isNil(elem) {
+				continue
+			}
+			e.writeString(k.String())
+			if err := e.value(elem); err != nil {
+				return err
+			}
+		}
+		e.w.WriteByte('e')
+	case reflect.Struct:
+		return e.structValue(v)
+	default:
+		return fmt.Errorf("bencode: cannot encode value of type %s", v.Type())
+	}
+	return nil
+}
+
+// structValue writes a struct as a dictionary, merging in the entries of
+// its extra map in key order
+func (e *Encoder) structValue(v reflect.Value) error {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	fields := cachedFields(v.Type())
+	var entries []entry
+	for _, f := range fields.list {
+		elem := v.FieldByIndex(f.index)
+		if isNil(elem) || (f.omitEmpty && isEmpty(elem)) {
+			continue
+		}
+		entries = append(entries, entry{f.key, elem})
+	}
+	if fields.extra != nil {
+		extra := v.FieldByIndex(fields.extra)
+		for _, k := range extra.MapKeys() {
+			// Keys of fields are theirs even when the field is omitted
+			if _, ok := fields.byKey[k.String()]; ok || isNil(extra.MapIndex(k)) {
+				continue
+			}
+			entries = append(entries, entry{k.String(), extra.MapIndex(k)})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	}
+
+	e.w.WriteByte('d')
+	for _, en := range entries {
+		e.writeString(en.key)
+		if err := e.value(en.value); err != nil {
+			return err
+		}
+	}
+	e.w.WriteByte('e')
+	return nil
+}
+
+// isEmpty reports values dropped by omitempty
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// isNil reports values that are omitted from dictionaries
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map:
+		return v.IsNil()
+	case reflect.Slice:
+		return v.IsNil() && v.Type() == rawMessageType
+	}
+	return false
+}
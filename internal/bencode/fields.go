@@ -0,0 +1,60 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field is a struct field mapped to a dictionary key
+type field struct {
+	key       string
+	index     []int
+	omitEmpty bool
+}
+
+type structFields struct {
+	list  []field // sorted by key, the encoding order
+	byKey map[string]field
+	extra []int // index of the map collecting keys no field takes, if any
+}
+
+var fieldCache sync.Map // reflect.Type -> *structFields
+
+// cachedFields returns the bencode fields of a struct type. Untagged
+// exported fields use their Go name, and a tag of "-" skips the field. A
+// map with string keys tagged ",extra" holds the entries of keys no other
+// field takes.
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+
+	fields := &structFields{byKey: make(map[string]field)}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" && opts == "extra" && sf.Type.Kind() == reflect.Map && sf.Type.Key().Kind() == reflect.String {
+			fields.extra = sf.Index
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		f := field{key: name, index: sf.Index, omitEmpty: opts == "omitempty"}
+		fields.list = append(fields.list, f)
+		fields.byKey[name] = f
+	}
+	sort.Slice(fields.list, func(i, j int) bool { return fields.list[i].key < fields.list[j].key })
+
+	actual, _ := fieldCache.LoadOrStore(t, fields)
+	return actual.(*structFields)
+}
@@ -4,22 +4,69 @@ import "time"
 
 // Config holds all tunable parameters for the BitTorrent client
 type Config struct {
-	BlockSize        int
-	HandshakeTimeout time.Duration
-	TCPTimeout       time.Duration // Fixed: was TcpTimeout
-	PieceTimeout     time.Duration
-	TrackerTimeout   time.Duration
-	RequestBacklog   int
+	BlockSize         int
+	HandshakeTimeout  time.Duration
+	TCPTimeout        time.Duration // Fixed: was TcpTimeout
+	PieceTimeout      time.Duration
+	TrackerTimeout    time.Duration
+	RequestBacklog    int           // outstanding block requests per peer until its throughput is known
+	MaxRequestBacklog int           // upper bound on the adaptive request queue, also limited by the peer's reqq
+	ResumeInterval    time.Duration // how often resume state is saved while downloading
+	Sequential        bool          // download pieces in order, for streaming
+	Readahead         int64         // bytes ahead of a reader to prioritise
+	WebSeedTimeout    time.Duration
+	WebSeedMaxBackoff time.Duration // upper bound on retry delay for failing web seeds
+	EnableLSD         bool          // local service discovery (BEP 14), never used for private torrents
+	ScrapeInterval    time.Duration // how often trackers are scraped for swarm stats
+	ListenPort        uint16        // port incoming peer connections are accepted on, 0 for any
+	NumWant           int           // peers to ask trackers for
+	AnnounceIP        string        // optional address reported to trackers
+	AnnounceIPv4      string
+	AnnounceIPv6      string
+	MaxConnections    int           // connected peers per torrent
+	MaxHalfOpen       int           // connection attempts in progress at once
+	PeerRetryDelay    time.Duration // first retry delay for a failed peer, doubling per failure
+	PeerMaxRetryDelay time.Duration
+	MaxPeerFailures   int           // consecutive failures after which a peer is forgotten
+	KeepAliveInterval time.Duration // write inactivity after which a keep-alive is sent
+	PeerReadTimeout   time.Duration // read inactivity after which a peer is dropped
+	PeerIdleTimeout   time.Duration // how long a peer may be neither interested nor interesting
+	ProxyURL          string        // socks5:// or http:// proxy with optional credentials, empty for none
+	ProxyPeers        bool          // connect to peers through the proxy
+	ProxyTrackers     bool          // contact trackers through the proxy, UDP ones need SOCKS5
+	ProxyWebSeeds     bool          // fetch from web seeds through the proxy
+	IPFilter          string        // blocklist of peer addresses (eMule, P2P or CIDR, optionally gzipped)
 }
 
 // Default returns a Config with sensible default values
 func Default() *Config {
 	return &Config{
-		BlockSize:        16 * 1024,
-		HandshakeTimeout: 15 * time.Second,
-		TCPTimeout:       15 * time.Second,
-		PieceTimeout:     30 * time.Second,
-		TrackerTimeout:   30 * time.Second,
-		RequestBacklog:   50,
+		BlockSize:         16 * 1024,
+		HandshakeTimeout:  15 * time.Second,
+		TCPTimeout:        15 * time.Second,
+		PieceTimeout:      30 * time.Second,
+		TrackerTimeout:    30 * time.Second,
+		RequestBacklog:    50,
+		MaxRequestBacklog: 500,
+		ResumeInterval:    30 * time.Second,
+		Sequential:        false,
+		Readahead:         4 * 1024 * 1024,
+		WebSeedTimeout:    60 * time.Second,
+		WebSeedMaxBackoff: 5 * time.Minute,
+		EnableLSD:         true,
+		ScrapeInterval:    15 * time.Minute,
+		ListenPort:        6881,
+		NumWant:           50,
+		MaxConnections:    50,
+		MaxHalfOpen:       8,
+		PeerRetryDelay:    30 * time.Second,
+		PeerMaxRetryDelay: 15 * time.Minute,
+		MaxPeerFailures:   5,
+		KeepAliveInterval: 2 * time.Minute,
+		PeerReadTimeout:   3 * time.Minute,
+		PeerIdleTimeout:   5 * time.Minute,
+		ProxyPeers:        true,
+		ProxyTrackers:     true,
+		ProxyWebSeeds:     true,
 	}
 }
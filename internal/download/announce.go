@@ -0,0 +1,151 @@
+package download
+
+import (
+	"btc/internal/logger"
+	"btc/internal/tracker"
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	announceRetryDelay      = time.Minute
+)
+
+// Announced records the tracker's first response, which Prepare obtained
+// before the download started, so re-announcing follows its interval
+func (t *Torrent) Announced(resp *tracker.AnnounceResponse) {
+	t.announceWait = announceInterval(resp)
+	t.updateSwarm(resp)
+}
+
+// announceInterval is how long the tracker wants us to wait
+func announceInterval(resp *tracker.AnnounceResponse) time.Duration {
+	interval := resp.Interval
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	return max(interval, resp.MinInterval)
+}
+
+func (t *Torrent) updateSwarm(resp *tracker.AnnounceResponse) {
+	if resp.Seeders == 0 && resp.Leechers == 0 {
+		return // not reported
+	}
+	s := t.Swarm()
+	s.Seeders, s.Leechers, s.Updated = resp.Seeders, resp.Leechers, time.Now()
+	t.SetSwarm(s)
+}
+
+// bytesLeft is the amount of content not yet verified. Resume data is only
+// known once the torrent is open.
+func (t *Torrent) bytesLeft() int64 {
+	if t.blocks == nil {
+		return int64(t.Length)
+	}
+	var left int64
+	for index := range t.NumPieces() {
+		if !t.blocks.isComplete(index) {
+			left += int64(t.PieceSize(index))
+		}
+	}
+	return left
+}
+
+// AnnounceRequest describes the download's current state to a tracker
+func (t *Torrent) AnnounceRequest(event string) *tracker.AnnounceRequest {
+	return &tracker.AnnounceRequest{
+		InfoHash:   t.InfoHash,
+		PeerID:     t.PeerID,
+		Port:       t.Cfg.ListenPort,
+		Downloaded: t.downloaded.Load(),
+		Left:       t.bytesLeft(),
+		Corrupt:    t.corrupt.Load(),
+		Redundant:  t.redundant.Load(),
+		Event:      event,
+		NumWant:    t.Cfg.NumWant,
+		Key:        t.AnnounceKey,
+		IP:         t.Cfg.AnnounceIP,
+		IPv4:       t.Cfg.AnnounceIPv4,
+		IPv6:       t.Cfg.AnnounceIPv6,
+	}
+}
+
+// InfoHashes returns the info hashes the torrent is known by: InfoHash,
+// and HybridInfoHash for hybrid torrents
+func (t *Torrent) InfoHashes() [][20]byte {
+	if t.HybridInfoHash == ([20]byte{}) {
+		return [][20]byte{t.InfoHash}
+	}
+	return [][20]byte{t.InfoHash, t.HybridInfoHash}
+}
+
+// Announce sends event to the tracker under every info hash of the torrent
+// and returns the response for InfoHash. Peers of the other swarms are
+// added with AddPeers.
+func (t *Torrent) Announce(event string) (*tracker.AnnounceResponse, error) {
+	resp, err := t.Tracker.Announce(t.AnnounceRequest(event))
+	for _, infoHash := range t.InfoHashes()[1:] {
+		req := t.AnnounceRequest(event)
+		req.InfoHash = infoHash
+		other, err := t.Tracker.Announce(req)
+		if err != nil {
+			logger.Debug("announcing the v2 info hash failed", "event", event, "error", err)
+			continue
+		}
+		t.AddPeers(SourceTracker, other.Peers)
+	}
+	return resp, err
+}
+
+// announceEvent tells the tracker the download completed or stopped
+func (t *Torrent) announceEvent(event string) {
+	if t.Tracker == nil {
+		return
+	}
+	if _, err := t.Announce(event); err != nil {
+		logger.Debug("announce failed", "event", event, "error", err)
+		return
+	}
+	logger.Debug("announced", "event", event)
+}
+
+// announceLoop re-announces to the tracker whenever it asks to, adding the
+// peers it returns, until ctx is done. Failed announces are retried with
+// backoff up to the tracker's interval.
+func (t *Torrent) announceLoop(ctx context.Context) {
+	if t.announceWait <= 0 {
+		t.announceWait = defaultAnnounceInterval
+	}
+	wait := t.announceWait
+	retry := announceRetryDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.stopped:
+			return
+		case <-time.After(wait):
+		}
+
+		resp, err := t.Announce(tracker.EventNone)
+		if err != nil {
+			var failure *tracker.FailureError
+			if errors.As(err, &failure) {
+				logger.Warn("tracker rejected announce", "reason", failure.Reason)
+			} else {
+				logger.Debug("re-announce failed", "error", err)
+			}
+			wait = min(retry, t.announceWait)
+			retry *= 2
+			continue
+		}
+		retry = announceRetryDelay
+		t.announceWait = announceInterval(resp)
+		wait = t.announceWait
+		t.updateSwarm(resp)
+		logger.Debug("re-announced", "peers", len(resp.Peers), "next", wait)
+		t.AddPeers(SourceTracker, resp.Peers)
+	}
+}
@@ -0,0 +1,47 @@
+package download
+
+import (
+	"btc/internal/config"
+	"btc/internal/peer"
+	"btc/internal/tracker"
+	"net"
+	"testing"
+)
+
+// fakeTracker answers each info hash with its own peer
+type fakeTracker struct {
+	announced [][20]byte
+	peers     map[[20]byte]peer.Peer
+}
+
+func (f *fakeTracker) Announce(req *tracker.AnnounceRequest) (*tracker.AnnounceResponse, error) {
+	f.announced = append(f.announced, req.InfoHash)
+	return &tracker.AnnounceResponse{Peers: []peer.Peer{f.peers[req.InfoHash]}}, nil
+}
+
+func TestAnnounceHybrid(t *testing.T) {
+	v1, v2 := [20]byte{1}, [20]byte{2}
+	tr := &fakeTracker{peers: map[[20]byte]peer.Peer{
+		v1: {IP: net.IPv4(10, 0, 0, 1), Port: 1},
+		v2: {IP: net.IPv4(10, 0, 0, 2), Port: 2},
+	}}
+	tor := &Torrent{InfoHash: v1, Tracker: tr, Cfg: config.Default()}
+	if got := tor.InfoHashes(); len(got) != 1 || got[0] != v1 {
+		t.Fatalf("InfoHashes of a v1 torrent = %x", got)
+	}
+
+	tor.HybridInfoHash = v2
+	resp, err := tor.Announce(tracker.EventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.announced) != 2 || tr.announced[0] != v1 || tr.announced[1] != v2 {
+		t.Errorf("announced %x, want the v1 then the v2 info hash", tr.announced)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].Port != 1 {
+		t.Errorf("returned peers %v, want those of the v1 swarm", resp.Peers)
+	}
+	if len(tor.Peers) != 1 || tor.Peers[0].Port != 2 {
+		t.Errorf("added peers %v, want those of the v2 swarm", tor.Peers)
+	}
+}
@@ -0,0 +1,343 @@
+package download
+
+import (
+	"btc/internal/logger"
+	"btc/internal/peer"
+	"btc/internal/protocol"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sync"
+	"time"
+)
+
+// candidate is a known peer address that may be dialed
+type candidate struct {
+	peer      peer.Peer
+	source    PeerSource
+	failures  int // consecutive failed or short lived connections
+	nextDial  time.Time
+	connected bool
+}
+
+// connManager keeps up to MaxConnections peers connected, dialing at most
+// MaxHalfOpen at once. Candidates are tried in BEP 40 priority order, and
+// failed ones are retried with exponential backoff until they have failed
+// MaxPeerFailures times in a row.
+type connManager struct {
+	t          *Torrent
+	mu         sync.Mutex
+	candidates map[string]*candidate
+	active     int
+	halfOpen   int
+	selfIP     net.IP // our address as seen by peers, for BEP 40
+	wake       chan struct{}
+	// ctx and results are those of the running download, for incoming
+	// connections. running is false before run starts and after it ends.
+	ctx     context.Context
+	results chan *pieceResult
+	running bool
+}
+
+func newConnManager(t *Torrent) *connManager {
+	m := &connManager{
+		t:          t,
+		candidates: make(map[string]*candidate),
+		wake:       make(chan struct{}, 1),
+	}
+	for _, addr := range []string{t.Cfg.AnnounceIP, t.Cfg.AnnounceIPv4, t.Cfg.AnnounceIPv6} {
+		if ip := net.ParseIP(addr); ip != nil && m.selfIP == nil {
+			m.selfIP = ip
+		}
+	}
+	return m
+}
+
+// add makes peers available for dialing
+func (m *connManager) add(source PeerSource, peers []peer.Peer) {
+	m.mu.Lock()
+	for _, p := range peers {
+		addr := p.String()
+		if _, ok := m.candidates[addr]; !ok {
+			m.candidates[addr] = &candidate{peer: p, source: source}
+		}
+	}
+	m.mu.Unlock()
+	m.poke()
+}
+
+func (m *connManager) poke() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run dials candidates whenever a slot is free until the download stops
+func (m *connManager) run(ctx context.Context, results chan *pieceResult) {
+	m.mu.Lock()
+	m.ctx, m.results, m.running = ctx, results, true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.running = false
+		m.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		m.dial(ctx, results)
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.t.stopped:
+			return
+		case <-m.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dial starts connections to the best candidates while limits allow
+func (m *connManager) dial(ctx context.Context, results chan *pieceResult) {
+	var blocked []string
+	// Forgotten after unlocking, AddPeers locks in the other order
+	defer func() { m.t.forgetPeers(blocked) }()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg := m.t.Cfg
+	for m.active+m.halfOpen < cfg.MaxConnections && m.halfOpen < cfg.MaxHalfOpen {
+		c := m.best(&blocked)
+		if c == nil {
+			return
+		}
+		c.connected = true
+		m.halfOpen++
+		go m.connect(ctx, c, results)
+	}
+}
+
+// best returns the candidate to dial next: peers with fewer hash failure
+// strikes first, then by BEP 40 priority. Candidates the IP filter now
+// blocks are dropped and added to blocked. The caller holds mu.
+func (m *connManager) best(blocked *[]string) *candidate {
+	now := time.Now()
+	var best *candidate
+	var bestStrikes int
+	var bestPrio uint32
+	for addr, c := range m.candidates {
+		if c.connected || now.Before(c.nextDial) {
+			continue
+		}
+		if m.t.IsBanned(c.peer.IP.String()) {
+			delete(m.candidates, addr)
+			continue
+		}
+		if !m.t.PeerAllowed(c.peer.IP) {
+			delete(m.candidates, addr)
+			*blocked = append(*blocked, addr)
+			continue
+		}
+		strikes := m.t.reputation.strikesOf(c.peer.IP.String())
+		prio := canonicalPriority(m.selfIP, c.peer, m.t.Cfg.ListenPort)
+		if best == nil || cmp.Or(cmp.Compare(strikes, bestStrikes), cmp.Compare(bestPrio, prio)) < 0 {
+			best, bestStrikes, bestPrio = c, strikes, prio
+		}
+	}
+	return best
+}
+
+// connect runs one connection and schedules the candidate's next attempt
+func (m *connManager) connect(ctx context.Context, c *candidate, results chan *pieceResult) {
+	handshook := false
+	started := time.Now()
+	err := m.t.StartWorker(ctx, c.peer, c.source, results, func(local net.Addr) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		handshook = true
+		m.halfOpen--
+		m.active++
+		if m.selfIP == nil {
+			if tcp, ok := local.(*net.TCPAddr); ok {
+				m.selfIP = tcp.IP
+			}
+		}
+	})
+
+	var blocked []string
+	defer func() { m.t.forgetPeers(blocked) }()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if handshook {
+		m.active--
+	} else {
+		m.halfOpen--
+	}
+	c.connected = false
+
+	cfg := m.t.Cfg
+	switch {
+	case err == nil || ctx.Err() != nil:
+		// The download finished or was cancelled
+	case errors.Is(err, errBlocked):
+		delete(m.candidates, c.peer.String())
+		blocked = append(blocked, c.peer.String())
+	case errors.As(err, new(*protocol.ProtocolError)):
+		// A peer that breaks the protocol is not worth another attempt
+		delete(m.candidates, c.peer.String())
+	case errors.Is(err, errIdle):
+		// The peer may have new pieces by the time we come back
+		c.failures = 0
+		c.nextDial = time.Now().Add(cfg.PeerIdleTimeout)
+	case handshook && time.Since(started) > cfg.PeerRetryDelay:
+		// A connection that worked for a while is worth retrying soon
+		c.failures = 1
+		c.nextDial = time.Now().Add(cfg.PeerRetryDelay)
+	default:
+		c.failures++
+		if c.failures >= cfg.MaxPeerFailures {
+			delete(m.candidates, c.peer.String())
+			break
+		}
+		backoff := cfg.PeerRetryDelay << (c.failures - 1)
+		c.nextDial = time.Now().Add(min(backoff, cfg.PeerMaxRetryDelay))
+	}
+	m.poke()
+}
+
+// Errors refusing incoming connections
+var (
+	errNotRunning = errors.New("download is not running")
+	errFull       = errors.New("no free connection slot")
+)
+
+// AcceptPeer runs a connection a peer opened to us, whose handshake hs
+// has been read, until it ends. The connection is refused while the
+// download is not running, when the peer is banned or blocked by the IP
+// filter, and when MaxConnections peers are connected already.
+func (t *Torrent) AcceptPeer(conn net.Conn, hs *protocol.Handshake) error {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unexpected peer address %s", conn.RemoteAddr())
+	}
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	t.peersMu.Lock()
+	m := t.conns
+	t.peersMu.Unlock()
+	if m == nil {
+		return errNotRunning
+	}
+	if t.IsBanned(p.IP.String()) {
+		return errBanned
+	}
+	if !t.PeerAllowed(p.IP) {
+		return errBlocked
+	}
+	m.mu.Lock()
+	switch {
+	case !m.running:
+		m.mu.Unlock()
+		return errNotRunning
+	case m.active+m.halfOpen >= t.Cfg.MaxConnections:
+		m.mu.Unlock()
+		return errFull
+	}
+	m.active++
+	ctx, results := m.ctx, m.results
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.active--
+		m.mu.Unlock()
+		m.poke()
+	}()
+
+	c, err := peer.Accept(conn, p, hs, t.PeerID, t.handshakeReserved(), t.messageLimits(), t.Cfg)
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	defer c.Close()
+	logger.Debug("incoming peer connected", "peer", p.String(), "client", c.Info.String())
+	t.emitEvent("handshake_success", map[string]any{"peer": p.IP.String(), "client": c.Info.String(), "incoming": true})
+	return t.runWorker(ctx, c, SourceIncoming, results)
+}
+
+// counts returns the connected and dialing peers and the idle candidates
+func (m *connManager) counts() (connected, halfOpen, idle int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.candidates {
+		if !c.connected {
+			idle++
+		}
+	}
+	return m.active, m.halfOpen, idle
+}
+
+// canonicalPriority implements BEP 40: a CRC32-C of both addresses,
+// masked so peers in the same network compare by more of their address.
+// Higher values are dialed first. Without our own address all peers are
+// equal.
+func canonicalPriority(self net.IP, p peer.Peer, selfPort uint16) uint32 {
+	if self == nil {
+		return 0
+	}
+	a, b := self.To4(), p.IP.To4()
+	if a == nil || b == nil {
+		a, b = self.To16(), p.IP.To16()
+		if a == nil || b == nil || self.To4() != nil || p.IP.To4() != nil {
+			return 0
+		}
+	}
+
+	table := crc32.MakeTable(crc32.Castagnoli)
+	if a.Equal(b) {
+		ports := []uint16{selfPort, p.Port}
+		if ports[0] > ports[1] {
+			ports[0], ports[1] = ports[1], ports[0]
+		}
+		var buf [4]byte
+		binary.BigEndian.PutUint16(buf[0:2], ports[0])
+		binary.BigEndian.PutUint16(buf[2:4], ports[1])
+		return crc32.Checksum(buf[:], table)
+	}
+
+	var mask []byte
+	if len(a) == net.IPv4len {
+		switch {
+		case bytes.Equal(a[:3], b[:3]):
+			mask = []byte{0xff, 0xff, 0xff, 0xff}
+		case bytes.Equal(a[:2], b[:2]):
+			mask = []byte{0xff, 0xff, 0xff, 0x55}
+		default:
+			mask = []byte{0xff, 0xff, 0x55, 0x55}
+		}
+	} else {
+		// IPv6 uses the first 64 bits, with masks widening from /32
+		a, b = a[:8], b[:8]
+		switch {
+		case bytes.Equal(a[:5], b[:5]):
+			mask = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		case bytes.Equal(a[:4], b[:4]):
+			mask = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55}
+		default:
+			mask = []byte{0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55}
+		}
+	}
+	ma, mb := make([]byte, len(a)), make([]byte, len(b))
+	for i := range a {
+		ma[i], mb[i] = a[i]&mask[i], b[i]&mask[i]
+	}
+	if bytes.Compare(ma, mb) > 0 {
+		ma, mb = mb, ma
+	}
+	return crc32.Checksum(append(ma, mb...), table)
+}
@@ -0,0 +1,50 @@
+package download
+
+import (
+	"btc/internal/peer"
+	"net"
+	"testing"
+)
+
+func TestCanonicalPriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		self     string
+		peer     string
+		selfPort uint16
+		peerPort uint16
+		want     uint32
+	}{
+		// The worked examples of BEP 40
+		{"different subnets", "123.213.32.10", "98.76.54.32", 6881, 6881, 0xec2d7224},
+		{"same /24", "123.213.32.10", "123.213.32.234", 6881, 6881, 0x99568189},
+		// crc32-c(7BD52000 7BD52801)
+		{"same /16", "123.213.32.10", "123.213.40.1", 6881, 6881, 0xcbbe95d9},
+		// crc32-c(1AE1 1AE2), the ports in either order
+		{"same address", "1.2.3.4", "1.2.3.4", 6882, 6881, 0x67f8fe57},
+		// crc32-c(20010db800000000 2a00145040010000), the first 64 bits
+		// masked outside the /32
+		{"ipv6 different /32", "2001:db8::1", "2a00:1450:4001:800::200e", 6881, 6881, 0x2474254c},
+		// crc32-c(20010db800000001 20010db800000002)
+		{"ipv6 same /40", "2001:db8:0:1::5", "2001:db8:0:2::9", 6881, 6881, 0x4fd0de3a},
+		{"mixed families", "1.2.3.4", "2001:db8::1", 6881, 6881, 0},
+		{"mapped ipv4 peer", "123.213.32.10", "::ffff:98.76.54.32", 6881, 6881, 0xec2d7224},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			self, other := net.ParseIP(tt.self), net.ParseIP(tt.peer)
+			got := canonicalPriority(self, peer.Peer{IP: other, Port: tt.peerPort}, tt.selfPort)
+			if got != tt.want {
+				t.Errorf("priority = %08x, want %08x", got, tt.want)
+			}
+			// Both ends compute the same priority
+			if back := canonicalPriority(other, peer.Peer{IP: self, Port: tt.selfPort}, tt.peerPort); back != got {
+				t.Errorf("priority from the other end = %08x, want %08x", back, got)
+			}
+		})
+	}
+
+	if got := canonicalPriority(nil, peer.Peer{IP: net.ParseIP("1.2.3.4")}, 6881); got != 0 {
+		t.Errorf("priority without our address = %08x, want 0", got)
+	}
+}
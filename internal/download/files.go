@@ -0,0 +1,203 @@
+package download
+
+import (
+	"btc/internal/storage"
+	"fmt"
+	"path"
+	"path/filepath"
+)
+
+// FilePriority controls whether and how eagerly a file is downloaded
+type FilePriority int
+
+const (
+	PrioritySkip FilePriority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p FilePriority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("FilePriority(%d)", int(p))
+	}
+}
+
+// files returns the file list, treating a torrent without one as a single file
+func (t *Torrent) files() []File {
+	if len(t.Files) == 0 {
+		return []File{{Path: t.Name, Length: int64(t.Length)}}
+	}
+	return t.Files
+}
+
+// storageFiles maps the torrent files to paths below outputPath. A single
+// file torrent is written to outputPath itself.
+func (t *Torrent) storageFiles(outputPath string) []storage.FileSpec {
+	files := t.files()
+	specs := make([]storage.FileSpec, len(files))
+	for i, f := range files {
+		p := outputPath
+		if t.MultiFile {
+			p = filepath.Join(outputPath, filepath.FromSlash(f.Path))
+		}
+		specs[i] = storage.FileSpec{Path: p, Length: f.Length, Pad: f.Pad}
+	}
+	return specs
+}
+
+// FilePriorities returns the current priority of each file
+func (t *Torrent) FilePriorities() []FilePriority {
+	t.prioMu.Lock()
+	defer t.prioMu.Unlock()
+	t.initPriorities()
+	return append([]FilePriority(nil), t.filePriority...)
+}
+
+// SetFilePriority changes the priority of a file. It may be called before
+// the download is opened or while it runs.
+func (t *Torrent) SetFilePriority(index int, prio FilePriority) error {
+	if prio < PrioritySkip || prio > PriorityHigh {
+		return fmt.Errorf("invalid file priority %d", prio)
+	}
+
+	t.prioMu.Lock()
+	t.initPriorities()
+	if index < 0 || index >= len(t.filePriority) {
+		t.prioMu.Unlock()
+		return fmt.Errorf("file index %d out of range", index)
+	}
+	t.filePriority[index] = prio
+	t.prioMu.Unlock()
+
+	t.applyPriorities()
+	return nil
+}
+
+// SelectFiles skips every file not matching one of the only patterns (when
+// given) or matching one of the exclude patterns. Patterns use path.Match
+// syntax and are tried against both the full path and the base name.
+func (t *Torrent) SelectFiles(only, exclude []string) error {
+	matches := func(patterns []string, name string) (bool, error) {
+		for _, pattern := range patterns {
+			for _, candidate := range []string{name, path.Base(name)} {
+				ok, err := path.Match(pattern, candidate)
+				if err != nil {
+					return false, fmt.Errorf("bad pattern %q: %w", pattern, err)
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	for i, f := range t.files() {
+		keep := true
+		if len(only) > 0 {
+			ok, err := matches(only, f.Path)
+			if err != nil {
+				return err
+			}
+			keep = ok
+		}
+		excluded, err := matches(exclude, f.Path)
+		if err != nil {
+			return err
+		}
+		prio := PriorityNormal
+		if !keep || excluded || f.Pad {
+			prio = PrioritySkip
+		}
+		if err := t.SetFilePriority(i, prio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initPriorities defaults every file to normal. The caller must hold prioMu.
+func (t *Torrent) initPriorities() {
+	if t.filePriority == nil {
+		t.filePriority = make([]FilePriority, len(t.files()))
+		for i, f := range t.files() {
+			if !f.Pad {
+				t.filePriority[i] = PriorityNormal
+			}
+		}
+	}
+}
+
+// piecePriorities derives piece priorities from file priorities. A boundary
+// piece shared between files takes the highest priority among them, so a
+// wanted file is never cut short by a skipped neighbour. The shared piece is
+// downloaded and written in full, which may create the skipped file.
+func (t *Torrent) piecePriorities() []int {
+	t.prioMu.Lock()
+	defer t.prioMu.Unlock()
+	t.initPriorities()
+
+	prios := make([]int, t.NumPieces())
+	pieceLen := int64(t.PieceLength)
+	var offset int64
+	for i, f := range t.files() {
+		if f.Length == 0 {
+			continue
+		}
+		first := int(offset / pieceLen)
+		last := int((offset + f.Length - 1) / pieceLen)
+		for index := first; index <= last && index < len(prios); index++ {
+			prios[index] = max(prios[index], int(t.filePriority[i]))
+		}
+		offset += f.Length
+	}
+	return prios
+}
+
+// applyPriorities pushes the current file priorities to the picker
+func (t *Torrent) applyPriorities() {
+	if t.picker == nil {
+		return
+	}
+	t.picker.setPriorities(t.piecePriorities())
+	t.notifyPriorities()
+}
+
+// notifyPriorities wakes Download to look at what is wanted again
+func (t *Torrent) notifyPriorities() {
+	select {
+	case t.prioChanged <- struct{}{}:
+	default:
+	}
+}
+
+// wantedDone reports whether every piece with a non-skip priority is verified
+func (t *Torrent) wantedDone() bool {
+	done, wanted := t.wantedProgress()
+	return done == wanted
+}
+
+// wantedProgress counts the pieces with a non-skip priority and how many
+// of them are verified
+func (t *Torrent) wantedProgress() (done, wanted int) {
+	for index, prio := range t.picker.priorities() {
+		if prio <= int(PrioritySkip) {
+			continue
+		}
+		wanted++
+		if t.blocks.isComplete(index) {
+			done++
+		}
+	}
+	return done, wanted
+}
@@ -2,39 +2,90 @@ package download
 
 import (
 	"btc/internal/config"
+	"btc/internal/ipfilter"
 	"btc/internal/logger"
 	"btc/internal/peer"
-	"btc/internal/protocol"
 	"btc/internal/stats"
 	"btc/internal/storage"
+	"btc/internal/tracker"
 	"bytes"
 	"context"
 	"crypto/sha1"
 	"fmt"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ProgressCallback func(percent float64, pieceIndex int, peerCount int, speed float64)
 type EventCallback func(event string, data map[string]any)
 
+// File is a file within the torrent content, located at Offset bytes into it.
+// Pad files only align the next file to a piece boundary and are never stored.
+type File struct {
+	Path   string
+	Length int64
+	Offset int64
+	Pad    bool
+}
+
 type Torrent struct {
-	PieceHashes [][20]byte
+	PieceHashes  [][20]byte // v1 piece hashes, empty for v2-only torrents
+	PieceRootsV2 []PieceRootV2
+	// PieceLayers maps a file's pieces root to its piece layer, for serving hash requests
+	PieceLayers map[[32]byte][][32]byte
 	Name        string
+	Files       []File
+	MultiFile   bool
 	Peers       []peer.Peer
+	Tracker     tracker.Tracker  // re-announced to while downloading, may be nil
+	AnnounceKey uint32           // random, identifies us to trackers across IP changes
+	Private     bool             // BEP 27, restricts peer discovery to trackers
+	Filter      *ipfilter.Filter // address ranges never to connect to, may be nil
+	WebSeeds    []string         // BEP 19 url-list
+	HTTPSeeds   []string         // BEP 17 httpseeds
 	Length      int
 	PieceLength int
 	PeerID      [20]byte
 	InfoHash    [20]byte
-	Cfg         *config.Config
-	rateCalc    *stats.RateCalculator
-	OnProgress  ProgressCallback
-	OnEvent     EventCallback
+	// HybridInfoHash is the truncated v2 info hash of a hybrid torrent,
+	// announced and accepted alongside InfoHash. It is zero otherwise.
+	HybridInfoHash [20]byte
+	Cfg            *config.Config
+	rateCalc       *stats.RateCalculator
+	storage        *storage.FileStorage
+	blocks         *blockTracker
+	reputation     *reputation
+	picker         *piecePicker
+	pieceDone      []chan struct{}
+	stopped        chan struct{}
+	resumePath     string
+	prioMu         sync.Mutex
+	filePriority   []FilePriority
+	prioChanged    chan struct{}
+	peersMu        sync.Mutex
+	knownPeers     map[string]PeerSource
+	conns          *connManager
+	announceWait   time.Duration
+	downloaded     atomic.Int64 // payload bytes received, including discarded ones
+	corrupt        atomic.Int64
+	redundant      atomic.Int64
+	blocked        atomic.Int64 // peers refused by the IP filter
+	readers        atomic.Int32 // open Readers, which keep Download running
+	peerStatsMu    sync.Mutex
+	peerStates     map[*peerState]struct{}
+	swarmMu        sync.Mutex
+	swarm          Swarm
+	OnProgress     ProgressCallback
+	OnEvent        EventCallback
+	stopHooks      []func()
 }
 
 type pieceWork struct {
 	index  int
 	hash   [20]byte
+	hasV1  bool
+	rootV2 *PieceRootV2
 	length int
 }
 
@@ -43,80 +94,17 @@ type pieceResult struct {
 	index  int
 }
 
-type pieceProgress struct {
-	client     *peer.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
-	index      int
-}
-
-func (state *pieceProgress) ReadMessage() error {
-	msg, err := state.client.Read()
-	if err != nil {
-		return err
-	}
-	if msg == nil {
-		return nil
-	}
-	switch msg.ID {
-	case protocol.MsgUnchoke:
-		state.client.Choke = false
-	case protocol.MsgChoke:
-		state.client.Choke = true
-	case protocol.MsgHave:
-		index, err := protocol.ParseHave(msg)
-		if err != nil {
-			return err
-		}
-		state.client.Bitfield.SetPiece(index)
-	case protocol.MsgPiece:
-		n, err := protocol.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
-	}
-	return nil
-}
-
-func (t *Torrent) DownloadPiece(c *peer.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
-	}
-	c.Conn.SetDeadline(time.Now().Add(t.Cfg.PieceTimeout))
-	defer c.Conn.SetDeadline(time.Time{})
-	for state.downloaded < pw.length {
-		if !state.client.Choke {
-			for state.backlog < t.Cfg.RequestBacklog && state.requested < pw.length {
-				blockSize := t.Cfg.BlockSize
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, fmt.Errorf("sending request for piece %d: %w", pw.index, err)
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
-		}
-		err := state.ReadMessage()
-		if err != nil {
-			return nil, fmt.Errorf("reading message for piece %d: %w", pw.index, err)
+// CheckIntegrity verifies a piece against its v1 hash and, for v2 and
+// hybrid torrents, its merkle root
+func CheckIntegrity(pw *pieceWork, buf []byte) error {
+	if pw.hasV1 {
+		hash := sha1.Sum(buf)
+		if !bytes.Equal(hash[:], pw.hash[:]) {
+			return fmt.Errorf("piece %d failed integrity check", pw.index)
 		}
 	}
-	return state.buf, nil
-}
-
-func CheckIntegrity(pw *pieceWork, buf []byte) error {
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(hash[:], pw.hash[:]) {
-		return fmt.Errorf("piece %d failed integrity check", pw.index)
+	if pw.rootV2 != nil {
+		return checkV2(pw, buf)
 	}
 	return nil
 }
@@ -127,45 +115,15 @@ func (t *Torrent) emitEvent(event string, data map[string]any) {
 	}
 }
 
-func (t *Torrent) StartWorker(ctx context.Context, p peer.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := peer.New(p, t.PeerID, t.InfoHash, t.Cfg)
-	if err != nil {
-		logger.Debug("handshake failed", "peer", p.IP.String(), "error", err)
-		t.emitEvent("handshake_failed", map[string]any{"peer": p.IP.String(), "error": err.Error()})
-		return
-	}
-	defer c.Close()
-	logger.Debug("handshake successful", "peer", p.IP.String())
-	t.emitEvent("handshake_success", map[string]any{"peer": p.IP.String()})
-	c.SendUnchoke()
-	c.SendInterested()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case pw, ok := <-workQueue:
-			if !ok {
-				return
-			}
-			if !c.Bitfield.HasPiece(pw.index) {
-				workQueue <- pw
-				continue
-			}
-			buf, err := t.DownloadPiece(c, pw)
-			if err != nil {
-				logger.Debug("piece download failed", "piece", pw.index, "error", err)
-				workQueue <- pw
-				return
-			}
-			err = CheckIntegrity(pw, buf)
-			if err != nil {
-				logger.Debug("integrity check failed", "piece", pw.index)
-				workQueue <- pw
-				continue
-			}
-			c.SendHave(pw.index)
-			results <- &pieceResult{buf, pw.index}
-		}
+// OnStop registers f to run when Download returns, such as to stop
+// announcing the torrent to other services
+func (t *Torrent) OnStop(f func()) {
+	t.stopHooks = append(t.stopHooks, f)
+}
+
+func (t *Torrent) runStopHooks() {
+	for _, f := range t.stopHooks {
+		f()
 	}
 }
 
@@ -183,79 +141,152 @@ func (t *Torrent) PieceSize(index int) int {
 	return end - begin
 }
 
-func (t *Torrent) Download(ctx context.Context, outputPath string) error {
-	logger.Info("starting download", "name", t.Name, "size", t.Length, "pieces", len(t.PieceHashes))
+// loadResume restores saved progress for outputPath and reports whether the
+// existing output file contents can be reused.
+func (t *Torrent) loadResume(resumePath string) bool {
+	if !storage.ResumeExists(resumePath) {
+		return false
+	}
+	resumeData, err := storage.LoadResume(resumePath)
+	if err != nil || !bytes.Equal(resumeData.InfoHash[:], t.InfoHash[:]) {
+		logger.Warn("resume file invalid or mismatched, starting fresh", "error", err)
+		return false
+	}
+	logger.Info("resuming download", "path", resumePath)
+	t.blocks.load(resumeData)
+	return true
+}
+
+func (t *Torrent) saveResume(resumePath string) {
+	err := storage.SaveResume(resumePath, t.blocks.snapshot())
+	if err != nil {
+		logger.Warn("failed to save resume state", "path", resumePath, "error", err)
+	}
+}
 
-	fs, err := storage.NewFileStorage(outputPath, t.PieceLength, t.Length)
+// Open prepares storage and piece state for outputPath so that readers can be
+// created before Download is started. The caller must Close the torrent.
+func (t *Torrent) Open(outputPath string) error {
+	t.resumePath = outputPath + ".resume"
+	t.blocks = newBlockTracker(t)
+	t.reputation = newReputation()
+	var err error
+	files := t.storageFiles(outputPath)
+	if t.loadResume(t.resumePath) {
+		t.storage, err = storage.OpenFileStorage(files, t.PieceLength)
+	} else {
+		t.storage, err = storage.NewFileStorage(files, t.PieceLength)
+	}
 	if err != nil {
 		return err
 	}
-	defer fs.Close()
+	t.recheckPieces()
 
-	resumePath := outputPath + ".resume"
-	completedPieces := make([]bool, len(t.PieceHashes))
-	donePieces := 0
-	if storage.ResumeExists(resumePath) {
-		resumeData, err := storage.LoadResume(resumePath)
-		if err == nil && bytes.Equal(resumeData.InfoHash[:], t.InfoHash[:]) {
-			logger.Info("resuming download", "path", resumePath)
-			completedPieces = resumeData.CompletedPieces
-			for _, completed := range completedPieces {
-				if completed {
-					donePieces++
-				}
-			}
-			logger.Info("resume state loaded", "completed", donePieces, "remaining", len(t.PieceHashes)-donePieces)
-		} else {
-			logger.Warn("resume file invalid or mismatched, starting fresh")
+	t.picker = newPiecePicker(t.NumPieces(), t.Cfg.Sequential)
+	t.picker.setPriorities(t.piecePriorities())
+	t.prioChanged = make(chan struct{}, 1)
+	t.pieceDone = make([]chan struct{}, t.NumPieces())
+	t.stopped = make(chan struct{})
+	for index := range t.pieceDone {
+		t.pieceDone[index] = make(chan struct{})
+		if t.blocks.isComplete(index) {
+			close(t.pieceDone[index])
+			continue
 		}
+		t.picker.requeue(t.newPieceWork(index))
+	}
+	return nil
+}
+
+// Close releases the storage opened by Open
+func (t *Torrent) Close() error {
+	return t.storage.Close()
+}
+
+// Download fetches all pieces into outputPath, opening the torrent first
+// unless Open has already been called.
+func (t *Torrent) Download(ctx context.Context, outputPath string) error {
+	logger.Info("starting download", "name", t.Name, "size", t.Length, "pieces", t.NumPieces())
+
+	if t.storage == nil {
+		if err := t.Open(outputPath); err != nil {
+			return err
+		}
+		defer t.Close()
+	}
+	fs := t.storage
+	resumePath := t.resumePath
+	defer t.runStopHooks()
+	defer t.announceEvent(tracker.EventStopped)
+	defer close(t.stopped)
+	defer t.picker.close()
+
+	donePieces := t.blocks.numComplete()
+	if donePieces > 0 {
+		logger.Info("resume state loaded", "completed", donePieces, "remaining", t.NumPieces()-donePieces)
 	}
 	t.rateCalc = stats.NewRateCalculator(1 * time.Second)
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
 	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
-		if !completedPieces[index] {
-			length := t.PieceSize(index)
-			workQueue <- &pieceWork{index, hash, length}
-		}
+	t.startConns()
+	go t.conns.run(ctx, results)
+	if t.Tracker != nil {
+		go t.announceLoop(ctx)
 	}
-	for _, p := range t.Peers {
-		go t.StartWorker(ctx, p, workQueue, results)
+	for _, seed := range t.newWebSeeds() {
+		go t.StartWebSeedWorker(ctx, seed, results)
 	}
 
-	for donePieces < len(t.PieceHashes) {
+	saveTicker := time.NewTicker(t.Cfg.ResumeInterval)
+	defer saveTicker.Stop()
+
+	// completed is only sent for downloads finished by this run
+	wasDone := t.wantedDone()
+	// Open readers may still fetch pieces of skipped files on demand
+	for !t.wantedDone() || t.readers.Load() > 0 {
 		select {
 		case <-ctx.Done():
-			close(workQueue)
 			logger.Info("download cancelled, saving resume state")
-			storage.SaveResume(resumePath, &storage.ResumeData{
-				InfoHash:        t.InfoHash,
-				CompletedPieces: completedPieces,
-				DownloadedBytes: int64(donePieces * t.PieceLength),
-			})
+			t.saveResume(resumePath)
 			return ctx.Err()
+		case <-saveTicker.C:
+			t.saveResume(resumePath)
+			st := t.Stats()
+			logger.Debug("download stats", "pieces", st.PiecesDone, "of", st.PiecesTotal, "peers", st.Connected,
+				"connecting", st.HalfOpen, "candidates", st.Candidates, "banned", len(st.Banned), "rate", st.DownloadRate)
+		case <-t.prioChanged:
 		case res := <-results:
 			// newer implementation on the file storage
-			err = fs.WritePiece(res.index, res.buffer)
+			err := fs.WritePiece(res.index, res.buffer)
 			if err != nil {
 				logger.Error("Issue while writing piece: " + err.Error())
 				return err
 			}
-			// might need to do something here instead of returning error on a peice , maybe requeueu or ask different peer or maybe something else. 
-			completedPieces[res.index] = true
+			// might need to do something here instead of returning error on a peice , maybe requeueu or ask different peer or maybe something else.
+			t.blocks.completePiece(res.index)
+			close(t.pieceDone[res.index])
 			donePieces++
 			t.rateCalc.Add(int64(len(res.buffer)))
-			percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-			numWorkers := runtime.NumGoroutine() - 1
+			// Progress is over the selected files only
+			percent := 100.0
+			if done, wanted := t.wantedProgress(); wanted > 0 {
+				percent = float64(done) / float64(wanted) * 100
+			}
 			if t.OnProgress != nil {
-				speed := t.rateCalc.Rate()
-				t.OnProgress(percent, res.index, numWorkers, speed)
+				connected, _, _ := t.conns.counts()
+				t.OnProgress(percent, res.index, connected, t.rateCalc.Rate())
 			}
 			logger.Debug("piece downloaded", "piece", res.index, "percent", percent)
+			if !wasDone && t.wantedDone() {
+				wasDone = true
+				logger.Info("selected files complete", "name", t.Name)
+				t.announceEvent(tracker.EventCompleted)
+			}
 		}
 	}
-	close(workQueue)
-	if storage.ResumeExists(resumePath) {
+	if donePieces < t.NumPieces() {
+		// Some files were skipped, keep their state for a later selection
+		t.saveResume(resumePath)
+	} else if storage.ResumeExists(resumePath) {
 		storage.DeleteResume(resumePath)
 		logger.Debug("resume file deleted")
 	}
@@ -0,0 +1,128 @@
+package download
+
+import (
+	"btc/internal/logger"
+	"btc/internal/peer"
+	"net"
+)
+
+// PeerSource says where a peer address was learned
+type PeerSource int
+
+const (
+	SourceTracker PeerSource = iota
+	SourceLSD
+	SourceDHT
+	SourcePEX
+	SourceIncoming // the peer connected to us
+)
+
+func (s PeerSource) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceLSD:
+		return "lsd"
+	case SourceDHT:
+		return "dht"
+	case SourcePEX:
+		return "pex"
+	case SourceIncoming:
+		return "incoming"
+	default:
+		return "unknown"
+	}
+}
+
+// DiscoveryAllowed reports whether a peer source may be used for this
+// torrent. Private torrents (BEP 27) only use their own trackers, and must
+// not announce their info hash anywhere else either.
+func (t *Torrent) DiscoveryAllowed(source PeerSource) bool {
+	return !t.Private || source == SourceTracker
+}
+
+// PeerAllowed reports whether the IP filter lets us talk to ip, counting
+// the peers it refuses. Both outgoing and incoming connections are checked.
+func (t *Torrent) PeerAllowed(ip net.IP) bool {
+	if t.Filter == nil || !t.Filter.Contains(ip) {
+		return true
+	}
+	t.blocked.Add(1)
+	return false
+}
+
+// AddPeers hands newly discovered peers to the download. Peers already
+// known are ignored, and peers from sources a private torrent may not use
+// or in ranges blocked by the IP filter are dropped. Peers added while the
+// download runs become connection candidates at once, earlier ones when it
+// starts.
+func (t *Torrent) AddPeers(source PeerSource, peers []peer.Peer) {
+	if !t.DiscoveryAllowed(source) {
+		logger.Debug("dropping peers for private torrent", "source", source, "count", len(peers))
+		return
+	}
+
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+
+	if t.knownPeers == nil {
+		t.knownPeers = make(map[string]PeerSource)
+	}
+	var fresh []peer.Peer
+	for _, p := range peers {
+		addr := p.String()
+		if _, known := t.knownPeers[addr]; known || t.IsBanned(p.IP.String()) {
+			continue
+		}
+		// Not remembered, so a reloaded filter can let the peer in later.
+		// Candidates the filter drops later are forgotten too.
+		if !t.PeerAllowed(p.IP) {
+			logger.Debug("peer blocked by IP filter", "peer", addr, "source", source)
+			continue
+		}
+		t.knownPeers[addr] = source
+		t.Peers = append(t.Peers, p)
+		fresh = append(fresh, p)
+	}
+	if t.conns != nil && len(fresh) > 0 {
+		t.conns.add(source, fresh)
+	}
+}
+
+// startConns creates the connection manager and queues the peers found so
+// far. Peers set on t.Peers directly rather than through AddPeers came
+// from the tracker.
+func (t *Torrent) startConns() {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+
+	if t.knownPeers == nil {
+		t.knownPeers = make(map[string]PeerSource)
+	}
+	t.conns = newConnManager(t)
+	for _, p := range t.Peers {
+		addr := p.String()
+		source, known := t.knownPeers[addr]
+		if !known {
+			if t.IsBanned(p.IP.String()) || !t.PeerAllowed(p.IP) {
+				continue
+			}
+			source = SourceTracker
+			t.knownPeers[addr] = source
+		}
+		t.conns.add(source, []peer.Peer{p})
+	}
+}
+
+// forgetPeers lets AddPeers take peers again, after the IP filter dropped
+// them
+func (t *Torrent) forgetPeers(addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	for _, addr := range addrs {
+		delete(t.knownPeers, addr)
+	}
+}
@@ -0,0 +1,113 @@
+package download
+
+import (
+	"btc/internal/stats"
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PeerStats is a snapshot of one peer connection
+type PeerStats struct {
+	Addr           string
+	Client         string
+	Source         PeerSource
+	ConnectedAt    time.Time
+	Downloaded     int64 // payload bytes received
+	Uploaded       int64 // payload bytes sent, we do not serve pieces yet
+	DownloadRate   float64
+	UploadRate     float64
+	PiecesReceived int
+	HashFailures   int
+	Requests       int // outstanding block requests
+	// Choke and interest state in both directions
+	PeerChoking    bool
+	PeerInterested bool
+	AmChoking      bool
+	AmInterested   bool
+}
+
+// Stats is a snapshot of the download
+type Stats struct {
+	PiecesDone   int
+	PiecesTotal  int
+	Downloaded   int64 // payload bytes received, including discarded ones
+	Corrupt      int64
+	Redundant    int64
+	DownloadRate float64
+	Connected    int
+	HalfOpen     int
+	Candidates   int   // known peers not connected
+	Blocked      int64 // peers refused by the IP filter
+	Peers        []PeerStats
+	Banned       []BannedPeer
+	Swarm        Swarm
+}
+
+// peerState is the live counterpart of PeerStats, updated by the worker
+type peerState struct {
+	mu   sync.Mutex
+	info PeerStats
+	rate *stats.RateCalculator
+}
+
+func (ps *peerState) update(fn func(*PeerStats)) {
+	ps.mu.Lock()
+	fn(&ps.info)
+	ps.mu.Unlock()
+}
+
+func (ps *peerState) snapshot() PeerStats {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	s := ps.info
+	s.DownloadRate = ps.rate.Rate()
+	return s
+}
+
+// trackPeer registers a connection for Stats until the returned func is called
+func (t *Torrent) trackPeer(info PeerStats) (*peerState, func()) {
+	ps := &peerState{info: info, rate: stats.NewRateCalculator(5 * time.Second)}
+	t.peerStatsMu.Lock()
+	if t.peerStates == nil {
+		t.peerStates = make(map[*peerState]struct{})
+	}
+	t.peerStates[ps] = struct{}{}
+	t.peerStatsMu.Unlock()
+	return ps, func() {
+		t.peerStatsMu.Lock()
+		delete(t.peerStates, ps)
+		t.peerStatsMu.Unlock()
+	}
+}
+
+// Stats returns a snapshot of the download and its connected peers
+func (t *Torrent) Stats() Stats {
+	s := Stats{
+		PiecesTotal: t.NumPieces(),
+		Downloaded:  t.downloaded.Load(),
+		Corrupt:     t.corrupt.Load(),
+		Redundant:   t.redundant.Load(),
+		Blocked:     t.blocked.Load(),
+		Banned:      t.BannedPeers(),
+		Swarm:       t.Swarm(),
+	}
+	if t.blocks != nil {
+		s.PiecesDone = t.blocks.numComplete()
+	}
+	if t.rateCalc != nil {
+		s.DownloadRate = t.rateCalc.Rate()
+	}
+	if t.conns != nil {
+		s.Connected, s.HalfOpen, s.Candidates = t.conns.counts()
+	}
+
+	t.peerStatsMu.Lock()
+	for ps := range t.peerStates {
+		s.Peers = append(s.Peers, ps.snapshot())
+	}
+	t.peerStatsMu.Unlock()
+	slices.SortFunc(s.Peers, func(a, b PeerStats) int { return cmp.Compare(b.DownloadRate, a.DownloadRate) })
+	return s
+}
@@ -0,0 +1,198 @@
+package download
+
+import "sync"
+
+// Piece priorities used by the picker, higher values are picked first.
+// Pieces at PrioritySkip are only handed out while boosted by a reader.
+const (
+	priorityNormal    = int(PriorityNormal)
+	priorityReadahead = 100
+	priorityNow       = 101
+)
+
+// piecePicker hands out pending pieces to workers by priority
+type piecePicker struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []*pieceWork
+	priority []int
+	// nowReaders and aheadReaders count the readers boosting each piece
+	// to priorityNow and priorityReadahead
+	nowReaders   []int
+	aheadReaders []int
+	sequential   bool
+	closed       bool
+	// notify is closed and replaced whenever work may have become available
+	notify chan struct{}
+}
+
+func newPiecePicker(numPieces int, sequential bool) *piecePicker {
+	pp := &piecePicker{
+		priority:     make([]int, numPieces),
+		nowReaders:   make([]int, numPieces),
+		aheadReaders: make([]int, numPieces),
+		sequential:   sequential,
+	}
+	for i := range pp.priority {
+		pp.priority[i] = priorityNormal
+	}
+	pp.cond = sync.NewCond(&pp.mu)
+	pp.notify = make(chan struct{})
+	return pp
+}
+
+func (pp *piecePicker) effective(index int) int {
+	switch {
+	case pp.nowReaders[index] > 0:
+		return max(pp.priority[index], priorityNow)
+	case pp.aheadReaders[index] > 0:
+		return max(pp.priority[index], priorityReadahead)
+	}
+	return pp.priority[index]
+}
+
+// next blocks until a pending piece accepted by has is available and
+// removes it from the queue. It returns nil once the picker is closed.
+func (pp *piecePicker) next(has func(int) bool) *pieceWork {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	for !pp.closed {
+		if pw := pp.take(has); pw != nil {
+			return pw
+		}
+		pp.cond.Wait()
+	}
+	return nil
+}
+
+// tryNext is next without waiting. ok is false once the picker is closed.
+func (pp *piecePicker) tryNext(has func(int) bool) (pw *pieceWork, ok bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.closed {
+		return nil, false
+	}
+	return pp.take(has), true
+}
+
+// changed returns a channel closed the next time pieces are requeued,
+// priorities change or the picker closes
+func (pp *piecePicker) changed() <-chan struct{} {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.notify
+}
+
+// wants reports whether a pending piece accepted by has is still wanted
+func (pp *piecePicker) wants(has func(int) bool) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	for _, pw := range pp.pending {
+		if pp.effective(pw.index) > int(PrioritySkip) && has(pw.index) {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes and returns the best pending piece accepted by has
+func (pp *piecePicker) take(has func(int) bool) *pieceWork {
+	best := -1
+	for i, pw := range pp.pending {
+		if pp.effective(pw.index) <= int(PrioritySkip) || !has(pw.index) {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		cur, prev := pp.effective(pw.index), pp.effective(pp.pending[best].index)
+		if cur > prev || (cur == prev && pp.sequential && pw.index < pp.pending[best].index) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	pw := pp.pending[best]
+	pp.pending = append(pp.pending[:best], pp.pending[best+1:]...)
+	return pw
+}
+
+// broadcast wakes everyone waiting for work, the caller holds mu
+func (pp *piecePicker) broadcast() {
+	pp.cond.Broadcast()
+	close(pp.notify)
+	pp.notify = make(chan struct{})
+}
+
+// setPriorities replaces the base priority of every piece
+func (pp *piecePicker) setPriorities(prios []int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	copy(pp.priority, prios)
+	pp.broadcast()
+}
+
+func (pp *piecePicker) priorities() []int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return append([]int(nil), pp.priority...)
+}
+
+// requeue puts a piece back so another worker can pick it up
+func (pp *piecePicker) requeue(pw *pieceWork) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.closed {
+		return
+	}
+	pp.pending = append(pp.pending, pw)
+	pp.broadcast()
+}
+
+// setBoost raises pieces in [first, last) to at least level, priorityNow
+// or priorityReadahead, on behalf of one reader. Each call is undone by a
+// clearBoost with the same arguments, so readers over the same pieces do
+// not drop each other's boosts.
+func (pp *piecePicker) setBoost(first, last, level int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.adjustBoost(first, last, level, 1)
+	pp.broadcast()
+}
+
+// clearBoost drops a boost added by setBoost
+func (pp *piecePicker) clearBoost(first, last, level int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.adjustBoost(first, last, level, -1)
+}
+
+// adjustBoost changes the reader counts of level for [first, last), the
+// caller holds mu
+func (pp *piecePicker) adjustBoost(first, last, level, delta int) {
+	counts := pp.aheadReaders
+	if level == priorityNow {
+		counts = pp.nowReaders
+	}
+	for i := max(first, 0); i < last && i < len(counts); i++ {
+		counts[i] = max(counts[i]+delta, 0)
+	}
+}
+
+// close wakes up all waiting workers and stops handing out work
+func (pp *piecePicker) close() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.closed = true
+	pp.broadcast()
+}
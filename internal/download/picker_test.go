@@ -0,0 +1,144 @@
+package download
+
+import (
+	"btc/internal/config"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func all(int) bool { return true }
+
+// takeAll drains the picker, returning the piece indexes in pick order
+func takeAll(pp *piecePicker) []int {
+	var order []int
+	for {
+		pw, _ := pp.tryNext(all)
+		if pw == nil {
+			return order
+		}
+		order = append(order, pw.index)
+	}
+}
+
+func TestPickerBoostFirst(t *testing.T) {
+	tests := []struct {
+		name       string
+		skip       []int
+		now, ahead [2]int
+		want       []int
+	}{
+		{"now before readahead", nil, [2]int{3, 4}, [2]int{4, 6}, []int{3, 4, 5, 0, 1, 2}},
+		{"readahead before normal", nil, [2]int{}, [2]int{2, 4}, []int{2, 3, 0, 1, 4, 5}},
+		{"boosted skipped pieces", []int{4, 5}, [2]int{5, 6}, [2]int{}, []int{5, 0, 1, 2, 3}},
+		{"skipped pieces stay out", []int{0, 1, 2, 3, 4, 5}, [2]int{}, [2]int{1, 2}, []int{1}},
+		{"boost over the end", nil, [2]int{5, 9}, [2]int{}, []int{5, 0, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Sequential, so pieces of the same priority come in order
+			pp := newPiecePicker(6, true)
+			prios := make([]int, 6)
+			for i := range prios {
+				prios[i] = priorityNormal
+			}
+			for _, i := range tt.skip {
+				prios[i] = int(PrioritySkip)
+			}
+			pp.setPriorities(prios)
+			for i := range 6 {
+				pp.requeue(&pieceWork{index: i})
+			}
+			pp.setBoost(tt.now[0], tt.now[1], priorityNow)
+			pp.setBoost(tt.ahead[0], tt.ahead[1], priorityReadahead)
+
+			got := takeAll(pp)
+			if len(got) != len(tt.want) {
+				t.Fatalf("picked %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("picked %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPickerBoostCounts(t *testing.T) {
+	pp := newPiecePicker(4, false)
+	pp.setBoost(0, 3, priorityNow)
+	pp.setBoost(1, 4, priorityNow)
+	pp.clearBoost(0, 3, priorityNow)
+	if pp.effective(0) != priorityNormal || pp.effective(1) != priorityNow || pp.effective(3) != priorityNow {
+		t.Error("clearing one boost dropped or kept the wrong pieces")
+	}
+	// Clearing more than was set does not go below zero
+	pp.clearBoost(1, 4, priorityNow)
+	pp.clearBoost(1, 4, priorityNow)
+	pp.setBoost(2, 3, priorityReadahead)
+	if pp.effective(1) != priorityNormal || pp.effective(2) != priorityReadahead {
+		t.Error("boost counts went negative")
+	}
+}
+
+// openTorrent opens a torrent of pieces pieces over files in a temporary
+// directory, without downloading
+func openTorrent(t *testing.T, pieces int, readahead int64) *Torrent {
+	t.Helper()
+	const pieceLen = 16 * 1024
+	cfg := config.Default()
+	cfg.Readahead = readahead
+	tor := &Torrent{
+		PieceHashes: make([][20]byte, pieces),
+		Name:        "x.bin",
+		Length:      pieces * pieceLen,
+		PieceLength: pieceLen,
+		Files:       []File{{Path: "x.bin", Length: int64(pieces * pieceLen)}},
+		Cfg:         cfg,
+	}
+	if err := tor.Open(filepath.Join(t.TempDir(), "x.bin")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tor.Close() })
+	return tor
+}
+
+func TestReaderCloseDropsBoost(t *testing.T) {
+	tor := openTorrent(t, 8, 3*16*1024)
+	ctx := context.Background()
+	r1, _ := tor.NewReader(ctx)
+	r2, _ := tor.NewReader(ctx)
+	// r1 is at piece 1 with readahead over 2 and 3, r2 at piece 3 with
+	// readahead over 4 and 5, so piece 3 is boosted by both
+	r1.Seek(16*1024, 0)
+	r2.Seek(3*16*1024, 0)
+
+	pp := tor.picker
+	check := func(name string, wantNow, wantAhead []int) {
+		t.Helper()
+		for i := range 8 {
+			if pp.nowReaders[i] != wantNow[i] || pp.aheadReaders[i] != wantAhead[i] {
+				t.Errorf("%s: now %v ahead %v, want %v %v", name, pp.nowReaders, pp.aheadReaders, wantNow, wantAhead)
+				return
+			}
+		}
+	}
+	check("both open",
+		[]int{0, 1, 0, 1, 0, 0, 0, 0},
+		[]int{0, 0, 1, 1, 1, 1, 0, 0})
+
+	r1.Close()
+	check("first closed",
+		[]int{0, 0, 0, 1, 0, 0, 0, 0},
+		[]int{0, 0, 0, 0, 1, 1, 0, 0})
+
+	// Closing twice changes nothing
+	r1.Close()
+	r2.Close()
+	r2.Close()
+	check("both closed", make([]int, 8), make([]int, 8))
+	if n := tor.readers.Load(); n != 0 {
+		t.Errorf("%d readers still counted", n)
+	}
+}
@@ -0,0 +1,85 @@
+package download
+
+import (
+	"btc/internal/config"
+	"btc/internal/stats"
+	"math"
+	"time"
+)
+
+const (
+	// defaultReqq is assumed for peers that do not advertise reqq
+	defaultReqq = 250
+	minBacklog  = 2
+	// rttWindow is how long the lowest round trip is remembered
+	rttWindow         = 10 * time.Second
+	minRequestTimeout = 5 * time.Second
+)
+
+// pipeline sizes a peer's request queue to its bandwidth-delay product.
+// The delay is the lowest recent round trip, which excludes the time
+// requests spend queued at the peer, so a deeper queue only pays off
+// while it raises throughput.
+type pipeline struct {
+	cfg         *config.Config
+	rate        *stats.RateCalculator
+	srtt        time.Duration // smoothed round trip including queueing
+	baseRTT     time.Duration
+	windowMin   time.Duration
+	windowStart time.Time
+}
+
+func newPipeline(cfg *config.Config) *pipeline {
+	return &pipeline{
+		cfg:         cfg,
+		rate:        stats.NewRateCalculator(5 * time.Second),
+		windowStart: time.Now(),
+	}
+}
+
+// sample records a block of n bytes arriving rtt after it was requested
+func (p *pipeline) sample(rtt time.Duration, n int) {
+	p.rate.Add(int64(n))
+	if p.srtt == 0 {
+		p.srtt = rtt
+	} else {
+		p.srtt += (rtt - p.srtt) / 8
+	}
+	if p.windowMin == 0 || rtt < p.windowMin {
+		p.windowMin = rtt
+	}
+	if p.baseRTT == 0 || rtt < p.baseRTT {
+		p.baseRTT = rtt
+	}
+	if time.Since(p.windowStart) > rttWindow {
+		// Forget old minimums so a route change is picked up
+		p.baseRTT, p.windowMin = p.windowMin, 0
+		p.windowStart = time.Now()
+	}
+}
+
+// target is how many requests to keep outstanding. Twice the
+// bandwidth-delay product keeps the pipe full while the estimate grows.
+func (p *pipeline) target(reqq int) int {
+	if reqq <= 0 {
+		reqq = defaultReqq
+	}
+	limit := max(min(reqq, p.cfg.MaxRequestBacklog), minBacklog)
+
+	rate := p.rate.Rate()
+	if rate == 0 || p.baseRTT == 0 {
+		return min(p.cfg.RequestBacklog, limit)
+	}
+	bdp := rate * p.baseRTT.Seconds() / float64(p.cfg.BlockSize)
+	return min(max(int(math.Ceil(2*bdp))+minBacklog, minBacklog), limit)
+}
+
+// timeout is how long a request may go unanswered before it is re-issued.
+// It stays below PieceTimeout, after which the whole peer is given up.
+func (p *pipeline) timeout() time.Duration {
+	limit := p.cfg.PieceTimeout / 2
+	if p.srtt == 0 {
+		return limit
+	}
+	return min(max(4*p.srtt, minRequestTimeout), limit)
+}
@@ -0,0 +1,95 @@
+package download
+
+import (
+	"btc/internal/config"
+	"testing"
+	"time"
+)
+
+// The rate is averaged over five seconds, so 5 MiB sampled at once is
+// 1 MiB/s. Round trips are powers of two in seconds to keep the
+// bandwidth-delay product exact.
+const sampledMiBps = 5 << 20
+
+func TestPipelineTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		bytes int
+		rtt   time.Duration
+		reqq  int
+		want  int
+	}{
+		{"no samples", 0, 0, 0, 50},
+		{"no samples, small reqq", 0, 0, 20, 20},
+		// 1 MiB/s for 125ms is 8 blocks in flight, doubled plus minBacklog
+		{"1 MiB/s", sampledMiBps, 125 * time.Millisecond, 0, 18},
+		{"4 MiB/s", 4 * sampledMiBps, 125 * time.Millisecond, 0, 66},
+		{"4 MiB/s, shorter round trip", 4 * sampledMiBps, 62500 * time.Microsecond, 0, 34},
+		{"over default reqq", 64 * sampledMiBps, 125 * time.Millisecond, 0, defaultReqq},
+		{"over advertised reqq", 64 * sampledMiBps, 125 * time.Millisecond, 100, 100},
+		{"over MaxRequestBacklog", 64 * sampledMiBps, 125 * time.Millisecond, 1000, 500},
+		// Any throughput keeps a request beyond minBacklog in flight
+		{"trickle", 1, time.Millisecond, 0, minBacklog + 1},
+		{"reqq below minBacklog", sampledMiBps, 125 * time.Millisecond, 1, minBacklog},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPipeline(config.Default())
+			if tt.bytes > 0 {
+				p.sample(tt.rtt, tt.bytes)
+			}
+			if got := p.target(tt.reqq); got != tt.want {
+				t.Errorf("target(%d) = %d, want %d", tt.reqq, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineAdapts(t *testing.T) {
+	p := newPipeline(config.Default())
+	steps := []struct {
+		name  string
+		bytes int
+		rtt   time.Duration
+		want  int
+	}{
+		{"first samples", sampledMiBps, 125 * time.Millisecond, 18},
+		{"throughput rises", 3 * sampledMiBps, 250 * time.Millisecond, 66},
+		{"lower round trip", 0, 62500 * time.Microsecond, 34},
+		// Queueing delay does not deepen the queue, only the lowest
+		// round trip counts
+		{"queued round trip", 0, 2 * time.Second, 34},
+	}
+	for _, s := range steps {
+		p.sample(s.rtt, s.bytes)
+		if got := p.target(0); got != s.want {
+			t.Errorf("%s: target = %d, want %d", s.name, got, s.want)
+		}
+	}
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		want time.Duration
+	}{
+		{"no samples", nil, 15 * time.Second},
+		{"fast peer", []time.Duration{100 * time.Millisecond}, minRequestTimeout},
+		{"slow peer", []time.Duration{2 * time.Second}, 8 * time.Second},
+		{"very slow peer", []time.Duration{10 * time.Second}, 15 * time.Second},
+		// 2s + (10s-2s)/8 smoothed
+		{"smoothed", []time.Duration{2 * time.Second, 10 * time.Second}, 12 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPipeline(config.Default())
+			for _, rtt := range tt.rtts {
+				p.sample(rtt, 1)
+			}
+			if got := p.timeout(); got != tt.want {
+				t.Errorf("timeout = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
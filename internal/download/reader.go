@@ -0,0 +1,174 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrDownloadStopped is returned by readers when the download ends before
+// the requested data has been verified.
+var ErrDownloadStopped = errors.New("download stopped")
+
+// Reader reads torrent content while it downloads. Reads block until the
+// pieces they cover pass their hash check, and the pieces around the read
+// position are prioritised. Reader implements io.ReadSeeker and io.ReaderAt.
+type Reader struct {
+	t         *Torrent
+	ctx       context.Context
+	mu        sync.Mutex
+	pos       int64
+	readahead int64
+	// pieces currently boosted by this reader: [first, now) to
+	// priorityNow and [now, last) to priorityReadahead
+	first, now, last int
+	closed           bool
+}
+
+// NewReader returns a reader over the torrent content. The torrent must have
+// been opened. Blocking reads are abandoned when ctx is done. Download keeps
+// running until the reader is closed, so it can fetch pieces of skipped
+// files.
+func (t *Torrent) NewReader(ctx context.Context) (*Reader, error) {
+	if t.storage == nil {
+		return nil, fmt.Errorf("torrent %s is not open", t.Name)
+	}
+	t.readers.Add(1)
+	return &Reader{
+		t:         t,
+		ctx:       ctx,
+		readahead: t.Cfg.Readahead,
+	}, nil
+}
+
+// SetReadahead sets how many bytes past the read position are prioritised
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readahead = n
+}
+
+// Read reads from the current position, see ReadAt
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+
+	n, err := r.ReadAt(p, pos)
+
+	r.mu.Lock()
+	r.pos = pos + int64(n)
+	r.mu.Unlock()
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the position for the next Read
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += int64(r.t.Length)
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.pos = offset
+	r.prioritise(offset, 0)
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes at off, waiting for the covering pieces
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	length := int64(r.t.Length)
+	if off >= length {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > length {
+		p = p[:length-off]
+	}
+
+	r.mu.Lock()
+	r.prioritise(off, int64(len(p)))
+	r.mu.Unlock()
+
+	pieceLen := int64(r.t.PieceLength)
+	for index := int(off / pieceLen); int64(index)*pieceLen < off+int64(len(p)); index++ {
+		if err := r.waitPiece(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.t.storage.ReadAt(p, off)
+	if err == nil && off+int64(n) == length {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close drops the priority this reader placed on pieces
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clearBoost()
+	r.first, r.now, r.last = 0, 0, 0
+	if !r.closed {
+		r.closed = true
+		r.t.readers.Add(-1)
+		r.t.notifyPriorities()
+	}
+	return nil
+}
+
+// prioritise moves this reader's boosted window to cover [off, off+n+readahead).
+// The caller must hold r.mu.
+func (r *Reader) prioritise(off, n int64) {
+	pieceLen := int64(r.t.PieceLength)
+	first := int(off / pieceLen)
+	now := int((off + max(n, 1) + pieceLen - 1) / pieceLen)
+	last := int((off + n + r.readahead + pieceLen - 1) / pieceLen)
+
+	r.clearBoost()
+	r.t.picker.setBoost(now, last, priorityReadahead)
+	r.t.picker.setBoost(first, now, priorityNow)
+	r.first, r.now, r.last = first, now, last
+}
+
+// clearBoost drops the boosts this reader holds. The caller must hold r.mu.
+func (r *Reader) clearBoost() {
+	r.t.picker.clearBoost(r.now, r.last, priorityReadahead)
+	r.t.picker.clearBoost(r.first, r.now, priorityNow)
+}
+
+func (r *Reader) waitPiece(index int) error {
+	select {
+	case <-r.t.pieceDone[index]:
+		return nil
+	default:
+	}
+	select {
+	case <-r.t.pieceDone[index]:
+		return nil
+	case <-r.t.stopped:
+		return ErrDownloadStopped
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+var (
+	_ io.ReadSeeker = (*Reader)(nil)
+	_ io.ReaderAt   = (*Reader)(nil)
+)
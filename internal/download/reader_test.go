@@ -0,0 +1,198 @@
+package download
+
+import (
+	"btc/internal/config"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReaderFetchesSkippedFile(t *testing.T) {
+	const pieceLen = 16 * 1024
+	data := make([]byte, 2*pieceLen)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/x/a.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "a.bin", time.Time{}, bytes.NewReader(data[:pieceLen]))
+	})
+	mux.HandleFunc("/x/b.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "b.bin", time.Time{}, bytes.NewReader(data[pieceLen:]))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := config.Default()
+	cfg.EnableLSD = false
+	tor := &Torrent{
+		PieceHashes: [][20]byte{sha1.Sum(data[:pieceLen]), sha1.Sum(data[pieceLen:])},
+		Name:        "x",
+		Length:      len(data),
+		PieceLength: pieceLen,
+		MultiFile:   true,
+		Files: []File{
+			{Path: "a.bin", Length: pieceLen},
+			{Path: "b.bin", Length: pieceLen, Offset: pieceLen},
+		},
+		WebSeeds: []string{srv.URL + "/"},
+		Cfg:      cfg,
+	}
+	if err := tor.SetFilePriority(1, PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := tor.Open(filepath.Join(out, "x")); err != nil {
+		t.Fatal(err)
+	}
+	defer tor.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r, err := tor.NewReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- tor.Download(ctx, filepath.Join(out, "x")) }()
+
+	// The selection completes first, the skipped file is read after
+	buf := make([]byte, pieceLen)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		t.Fatalf("reading the selected file: %v", err)
+	}
+	// The read ends at the end of the content
+	if n, err := r.ReadAt(buf, pieceLen); n != pieceLen || (err != nil && err != io.EOF) {
+		t.Fatalf("reading the skipped file: %v", err)
+	}
+	if !bytes.Equal(buf, data[pieceLen:]) {
+		t.Error("skipped file read back wrong")
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("download returned while a reader was open: %v", err)
+	default:
+	}
+	r.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readResult is the outcome of a read run in the background
+type readResult struct {
+	n   int
+	err error
+}
+
+func TestReaderWaitsForVerifiedPieces(t *testing.T) {
+	const pieceLen = 16 * 1024
+	tor := openTorrent(t, 3, 0)
+	data := make([]byte, 3*pieceLen)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	// complete stores a piece and marks it verified, as Download does with
+	// a piece that passed its hash check
+	complete := func(index int) {
+		if err := tor.storage.WritePiece(index, data[index*pieceLen:(index+1)*pieceLen]); err != nil {
+			t.Fatal(err)
+		}
+		tor.blocks.completePiece(index)
+		close(tor.pieceDone[index])
+	}
+	// waitRead returns the read's result, or fails the test if it is still
+	// blocked after a while
+	waitRead := func(results <-chan readResult) readResult {
+		t.Helper()
+		select {
+		case res := <-results:
+			return res
+		case <-time.After(5 * time.Second):
+			t.Fatal("read still blocked after its pieces were verified")
+			return readResult{}
+		}
+	}
+	assertBlocked := func(results <-chan readResult) {
+		t.Helper()
+		select {
+		case res := <-results:
+			t.Fatalf("read returned %d, %v before its pieces were verified", res.n, res.err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := tor.NewReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Read after a Seek waits for the piece at the new position
+	if _, err := r.Seek(pieceLen, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	results := make(chan readResult, 1)
+	go func() {
+		n, err := r.Read(buf)
+		results <- readResult{n, err}
+	}()
+	assertBlocked(results)
+	tor.picker.mu.Lock()
+	got := tor.picker.effective(1)
+	tor.picker.mu.Unlock()
+	if got != priorityNow {
+		t.Errorf("piece under a blocked read has priority %d, want %d", got, priorityNow)
+	}
+	complete(1)
+	if res := waitRead(results); res.err != nil || !bytes.Equal(buf, data[pieceLen:pieceLen+100]) {
+		t.Fatalf("read after the piece was verified: %d, %v", res.n, res.err)
+	}
+
+	// ReadAt across two pieces waits for both
+	span := make([]byte, 200)
+	go func() {
+		n, err := r.ReadAt(span, 2*pieceLen-100)
+		results <- readResult{n, err}
+	}()
+	assertBlocked(results)
+	complete(2)
+	if res := waitRead(results); res.n != 200 || (res.err != nil && res.err != io.EOF) ||
+		!bytes.Equal(span, data[2*pieceLen-100:2*pieceLen+100]) {
+		t.Fatalf("read across pieces: %d, %v", res.n, res.err)
+	}
+
+	// A blocked read gives up when its context is cancelled
+	go func() {
+		n, err := r.ReadAt(buf, 0)
+		results <- readResult{n, err}
+	}()
+	assertBlocked(results)
+	cancel()
+	if res := waitRead(results); res.err != context.Canceled {
+		t.Errorf("cancelled read returned %v, want %v", res.err, context.Canceled)
+	}
+
+	// and when the download stops
+	r2, _ := tor.NewReader(context.Background())
+	defer r2.Close()
+	go func() {
+		n, err := r2.ReadAt(buf, 0)
+		results <- readResult{n, err}
+	}()
+	assertBlocked(results)
+	close(tor.stopped)
+	if res := waitRead(results); res.err != ErrDownloadStopped {
+		t.Errorf("read after the download stopped returned %v, want %v", res.err, ErrDownloadStopped)
+	}
+}
@@ -0,0 +1,177 @@
+package download
+
+import (
+	"btc/internal/logger"
+	"cmp"
+	"crypto/sha1"
+	"slices"
+	"sync"
+)
+
+// maxStrikes is how many failed pieces a peer may share in before it is
+// banned without proof of which blocks were bad
+const maxStrikes = 3
+
+// BannedPeer is a peer refused for the rest of the session
+type BannedPeer struct {
+	IP     string
+	Reason string
+}
+
+// blockRecord remembers who sent a block of a failed piece and its hash
+type blockRecord struct {
+	peer string
+	hash [20]byte
+}
+
+// reputation attributes hash failures to the peers that sent the blocks.
+// A failed piece with a single contributor bans it outright. Otherwise the
+// block hashes are kept, and once the piece is downloaded again and passes
+// (smart ban), the peers whose blocks differ from the good data are banned.
+type reputation struct {
+	mu       sync.Mutex
+	owners   map[int][]string // piece -> block -> IP of the sender
+	suspects map[int][]blockRecord
+	strikes  map[string]int
+	banned   map[string]string // IP -> reason
+}
+
+func newReputation() *reputation {
+	return &reputation{
+		owners:   make(map[int][]string),
+		suspects: make(map[int][]blockRecord),
+		strikes:  make(map[string]int),
+		banned:   make(map[string]string),
+	}
+}
+
+// recordBlock notes that ip sent block number block of piece index
+func (r *reputation) recordBlock(index, block, numBlocks int, ip string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	owners, ok := r.owners[index]
+	if !ok {
+		owners = make([]string, numBlocks)
+		r.owners[index] = owners
+	}
+	if block < len(owners) {
+		owners[block] = ip
+	}
+}
+
+// pieceFailed assigns blame for a piece that failed its hash check and
+// returns the peers banned as a result
+func (r *reputation) pieceFailed(index int, buf []byte, blockSize int) []BannedPeer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	owners := r.owners[index]
+	delete(r.owners, index)
+	var senders []string
+	records := make([]blockRecord, len(owners))
+	for block, ip := range owners {
+		begin := block * blockSize
+		end := min(begin+blockSize, len(buf))
+		records[block] = blockRecord{peer: ip, hash: sha1.Sum(buf[begin:end])}
+		if ip != "" && !slices.Contains(senders, ip) {
+			senders = append(senders, ip)
+		}
+	}
+
+	var bans []BannedPeer
+	if len(senders) == 1 && !slices.Contains(owners, "") {
+		return append(bans, r.ban(senders[0], "sent a corrupt piece"))
+	}
+	if _, ok := r.suspects[index]; !ok {
+		r.suspects[index] = records
+	}
+	for _, ip := range senders {
+		r.strikes[ip]++
+		if r.strikes[ip] >= maxStrikes {
+			bans = append(bans, r.ban(ip, "took part in repeated hash failures"))
+		}
+	}
+	return bans
+}
+
+// piecePassed compares a verified piece with the blocks recorded when it
+// failed earlier and returns the peers banned as a result
+func (r *reputation) piecePassed(index int, buf []byte, blockSize int) []BannedPeer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.owners, index)
+	records, ok := r.suspects[index]
+	if !ok {
+		return nil
+	}
+	delete(r.suspects, index)
+
+	var bans []BannedPeer
+	for block, rec := range records {
+		if rec.peer == "" {
+			continue
+		}
+		begin := block * blockSize
+		end := min(begin+blockSize, len(buf))
+		if sha1.Sum(buf[begin:end]) != rec.hash {
+			bans = append(bans, r.ban(rec.peer, "sent a corrupt block"))
+		}
+	}
+	return bans
+}
+
+// ban records a ban, the caller holds mu
+func (r *reputation) ban(ip, reason string) BannedPeer {
+	if _, ok := r.banned[ip]; !ok {
+		r.banned[ip] = reason
+	}
+	return BannedPeer{IP: ip, Reason: r.banned[ip]}
+}
+
+func (r *reputation) isBanned(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.banned[ip]
+	return ok
+}
+
+// strikesOf returns how many failed pieces ip has contributed to
+func (r *reputation) strikesOf(ip string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.strikes[ip]
+}
+
+func (r *reputation) bannedPeers() []BannedPeer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peers := make([]BannedPeer, 0, len(r.banned))
+	for ip, reason := range r.banned {
+		peers = append(peers, BannedPeer{IP: ip, Reason: reason})
+	}
+	slices.SortFunc(peers, func(a, b BannedPeer) int { return cmp.Compare(a.IP, b.IP) })
+	return peers
+}
+
+// BannedPeers lists the peers banned for sending corrupt data
+func (t *Torrent) BannedPeers() []BannedPeer {
+	if t.reputation == nil {
+		return nil
+	}
+	return t.reputation.bannedPeers()
+}
+
+// IsBanned reports whether peers at ip are refused
+func (t *Torrent) IsBanned(ip string) bool {
+	return t.reputation != nil && t.reputation.isBanned(ip)
+}
+
+func (t *Torrent) reportBans(bans []BannedPeer) {
+	for _, b := range bans {
+		logger.Info("peer banned", "peer", b.IP, "reason", b.Reason)
+		t.emitEvent("peer_banned", map[string]any{"peer": b.IP, "reason": b.Reason})
+	}
+}
@@ -0,0 +1,113 @@
+package download
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+const testBlockSize = 4
+
+// failPiece records owners as the senders of the blocks of piece index and
+// fails it, returning the banned IPs
+func failPiece(r *reputation, index int, owners []string, buf []byte) []string {
+	for block, ip := range owners {
+		if ip != "" {
+			r.recordBlock(index, block, len(owners), ip)
+		}
+	}
+	var ips []string
+	for _, b := range r.pieceFailed(index, buf, testBlockSize) {
+		ips = append(ips, b.IP)
+	}
+	return ips
+}
+
+func TestBanThreshold(t *testing.T) {
+	bad := bytes.Repeat([]byte{0xee}, 3*testBlockSize)
+	tests := []struct {
+		name string
+		// failed pieces, each listing the sender of every block
+		failures   [][]string
+		wantBans   []string
+		wantStrike map[string]int
+	}{
+		{
+			name:     "sole sender banned at once",
+			failures: [][]string{{"a", "a", "a"}},
+			wantBans: []string{"a"},
+		},
+		{
+			name:       "shared failures below threshold",
+			failures:   [][]string{{"a", "b", "a"}, {"a", "b", "b"}},
+			wantStrike: map[string]int{"a": 2, "b": 2},
+		},
+		{
+			name:       "shared failures reach threshold",
+			failures:   [][]string{{"a", "b", "a"}, {"a", "c", "c"}, {"a", "b", "c"}},
+			wantBans:   []string{"a"},
+			wantStrike: map[string]int{"a": 3, "b": 2, "c": 2},
+		},
+		{
+			name:       "unknown block sender is not proof",
+			failures:   [][]string{{"a", "", "a"}},
+			wantStrike: map[string]int{"a": 1},
+		},
+		{
+			name:       "one strike per piece",
+			failures:   [][]string{{"a", "a", "b"}, {"b", "a", "a"}},
+			wantStrike: map[string]int{"a": 2, "b": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReputation()
+			var bans []string
+			for index, owners := range tt.failures {
+				bans = append(bans, failPiece(r, index, owners, bad)...)
+			}
+			if !slices.Equal(bans, tt.wantBans) {
+				t.Errorf("banned %v, want %v", bans, tt.wantBans)
+			}
+			for _, ip := range tt.wantBans {
+				if !r.isBanned(ip) {
+					t.Errorf("%s not reported as banned", ip)
+				}
+			}
+			for ip, want := range tt.wantStrike {
+				if got := r.strikesOf(ip); got != want {
+					t.Errorf("%s has %d strikes, want %d", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSmartBan(t *testing.T) {
+	good := []byte("aaaabbbbcccc")
+	bad := []byte("aaaaXbbbcccc")
+
+	r := newReputation()
+	if bans := failPiece(r, 0, []string{"a", "b", "c"}, bad); len(bans) != 0 {
+		t.Fatalf("shared failure banned %v", bans)
+	}
+	// The piece passes once downloaded again, block 1 differs from what b sent
+	for block, ip := range []string{"c", "c", "c"} {
+		r.recordBlock(0, block, 3, ip)
+	}
+	bans := r.piecePassed(0, good, testBlockSize)
+	if len(bans) != 1 || bans[0].IP != "b" {
+		t.Fatalf("smart ban banned %v, want b", bans)
+	}
+	if r.isBanned("a") || r.isBanned("c") {
+		t.Error("peers with good blocks banned")
+	}
+
+	// Passing again without a recorded failure bans no one
+	if bans := r.piecePassed(0, good, testBlockSize); len(bans) != 0 {
+		t.Errorf("second pass banned %v", bans)
+	}
+	if got := r.bannedPeers(); len(got) != 1 || got[0].Reason != "sent a corrupt block" {
+		t.Errorf("banned peers %v", got)
+	}
+}
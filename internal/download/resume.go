@@ -0,0 +1,180 @@
+package download
+
+import (
+	"btc/internal/logger"
+	"btc/internal/storage"
+	"sync"
+)
+
+// blockTracker records which pieces are verified and which blocks of
+// unverified pieces have already been written to disk.
+type blockTracker struct {
+	mu        sync.Mutex
+	t         *Torrent
+	completed []bool
+	partial   map[int][]bool
+	// recheck is set when completed came from a version 0 resume file
+	recheck bool
+}
+
+func newBlockTracker(t *Torrent) *blockTracker {
+	return &blockTracker{
+		t:         t,
+		completed: make([]bool, t.NumPieces()),
+		partial:   make(map[int][]bool),
+	}
+}
+
+func (bt *blockTracker) numBlocks(index int) int {
+	return (bt.t.PieceSize(index) + bt.t.Cfg.BlockSize - 1) / bt.t.Cfg.BlockSize
+}
+
+// load applies saved resume state. Partial blocks are only kept when the
+// layout they were recorded with matches the current one.
+func (bt *blockTracker) load(rd *storage.ResumeData) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if len(rd.CompletedPieces) == len(bt.completed) {
+		copy(bt.completed, rd.CompletedPieces)
+		bt.recheck = rd.Version == 0
+	}
+	if rd.PieceLength != bt.t.PieceLength || rd.BlockSize != bt.t.Cfg.BlockSize {
+		return
+	}
+	for index, blocks := range rd.PartialPieces {
+		if index < 0 || index >= len(bt.completed) || bt.completed[index] {
+			continue
+		}
+		if len(blocks) != bt.numBlocks(index) {
+			continue
+		}
+		bt.partial[index] = append([]bool(nil), blocks...)
+	}
+}
+
+// recheckPieces hashes the pieces a version 0 resume file claims against
+// the data on disk and keeps only those that match. Clients writing version
+// 0 truncated the output files on every run, so the data may be gone.
+func (t *Torrent) recheckPieces() {
+	bt := t.blocks
+	bt.mu.Lock()
+	if !bt.recheck {
+		bt.mu.Unlock()
+		return
+	}
+	bt.recheck = false
+	claimed := append([]bool(nil), bt.completed...)
+	bt.mu.Unlock()
+
+	var kept, dropped int
+	for index, done := range claimed {
+		if !done {
+			continue
+		}
+		buf := make([]byte, t.PieceSize(index))
+		err := t.storage.ReadBlock(index, 0, buf)
+		if err == nil {
+			err = CheckIntegrity(t.newPieceWork(index), buf)
+		}
+		if err != nil {
+			bt.mu.Lock()
+			bt.completed[index] = false
+			bt.mu.Unlock()
+			dropped++
+			continue
+		}
+		kept++
+	}
+	logger.Info("rechecked pieces of an old resume file", "kept", kept, "dropped", dropped)
+}
+
+// markBlock records a block as written and reports whether it was new
+func (bt *blockTracker) markBlock(index, begin int) bool {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	blocks, ok := bt.partial[index]
+	if !ok {
+		blocks = make([]bool, bt.numBlocks(index))
+		bt.partial[index] = blocks
+	}
+	block := begin / bt.t.Cfg.BlockSize
+	if block >= len(blocks) || blocks[block] {
+		return false
+	}
+	blocks[block] = true
+	return true
+}
+
+// hasBlock reports whether the block starting at begin is already on disk
+func (bt *blockTracker) hasBlock(index, begin int) bool {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	blocks, ok := bt.partial[index]
+	block := begin / bt.t.Cfg.BlockSize
+	return ok && block < len(blocks) && blocks[block]
+}
+
+// resetPiece forgets all blocks of a piece, e.g. after a failed hash check
+func (bt *blockTracker) resetPiece(index int) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	delete(bt.partial, index)
+}
+
+func (bt *blockTracker) completePiece(index int) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.completed[index] = true
+	delete(bt.partial, index)
+}
+
+func (bt *blockTracker) isComplete(index int) bool {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.completed[index]
+}
+
+func (bt *blockTracker) numComplete() int {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	n := 0
+	for _, done := range bt.completed {
+		if done {
+			n++
+		}
+	}
+	return n
+}
+
+// snapshot builds the resume data for the current state
+func (bt *blockTracker) snapshot() *storage.ResumeData {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	rd := &storage.ResumeData{
+		InfoHash:        bt.t.InfoHash,
+		PieceLength:     bt.t.PieceLength,
+		BlockSize:       bt.t.Cfg.BlockSize,
+		CompletedPieces: append([]bool(nil), bt.completed...),
+		PartialPieces:   make(map[int][]bool, len(bt.partial)),
+	}
+	for index, done := range bt.completed {
+		if done {
+			rd.DownloadedBytes += int64(bt.t.PieceSize(index))
+		}
+	}
+	for index, blocks := range bt.partial {
+		rd.PartialPieces[index] = append([]bool(nil), blocks...)
+		for block, have := range blocks {
+			if have {
+				begin := block * bt.t.Cfg.BlockSize
+				rd.DownloadedBytes += int64(min(bt.t.Cfg.BlockSize, bt.t.PieceSize(index)-begin))
+			}
+		}
+	}
+	return rd
+}
@@ -0,0 +1,64 @@
+package download
+
+import (
+	"btc/internal/config"
+	"btc/internal/storage"
+	"crypto/sha1"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadVersion0ResumeRechecksPieces(t *testing.T) {
+	const pieceLen = 32 * 1024
+	data := make([]byte, 3*pieceLen)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	var hashes [][20]byte
+	for i := 0; i < len(data); i += pieceLen {
+		hashes = append(hashes, sha1.Sum(data[i:i+pieceLen]))
+	}
+	infoHash := [20]byte{9}
+
+	// An old run truncated the output, leaving only the first piece
+	out := filepath.Join(t.TempDir(), "x.bin")
+	if err := os.WriteFile(out, data[:pieceLen], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old, err := json.Marshal(&storage.ResumeData{
+		InfoHash:        infoHash,
+		PieceLength:     pieceLen,
+		CompletedPieces: []bool{true, true, true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(out+".resume", old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tor := &Torrent{
+		PieceHashes: hashes,
+		Name:        "x.bin",
+		Length:      len(data),
+		PieceLength: pieceLen,
+		InfoHash:    infoHash,
+		Files:       []File{{Path: "x.bin", Length: int64(len(data))}},
+		Cfg:         config.Default(),
+	}
+	if err := tor.Open(out); err != nil {
+		t.Fatal(err)
+	}
+	defer tor.Close()
+
+	for index, want := range []bool{true, false, false} {
+		if got := tor.blocks.isComplete(index); got != want {
+			t.Errorf("piece %d complete = %v, want %v", index, got, want)
+		}
+	}
+	if got, err := os.ReadFile(out); err != nil || len(got) < pieceLen || string(got[:pieceLen]) != string(data[:pieceLen]) {
+		t.Error("the verified piece was not kept on disk")
+	}
+}
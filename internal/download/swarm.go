@@ -0,0 +1,26 @@
+package download
+
+import "time"
+
+// Swarm holds the swarm size last reported by the torrent's trackers
+type Swarm struct {
+	Seeders    int
+	Leechers   int
+	Downloaded int
+	Updated    time.Time // zero until a tracker has been scraped
+}
+
+// SetSwarm records the latest scrape results
+func (t *Torrent) SetSwarm(s Swarm) {
+	t.swarmMu.Lock()
+	t.swarm = s
+	t.swarmMu.Unlock()
+	t.emitEvent("swarm", map[string]any{"seeders": s.Seeders, "leechers": s.Leechers, "downloaded": s.Downloaded})
+}
+
+// Swarm returns the latest scrape results
+func (t *Torrent) Swarm() Swarm {
+	t.swarmMu.Lock()
+	defer t.swarmMu.Unlock()
+	return t.swarm
+}
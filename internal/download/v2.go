@@ -0,0 +1,91 @@
+package download
+
+import (
+	"btc/internal/merkle"
+	"btc/internal/peer"
+	"btc/internal/protocol"
+	"fmt"
+)
+
+// PieceRootV2 is the expected BEP 52 merkle root of a piece. Length is the
+// number of file bytes in the piece, which excludes any trailing padding.
+type PieceRootV2 struct {
+	Root   [32]byte
+	Leaves int
+	Length int
+}
+
+// NumPieces returns the number of pieces, which v2-only torrents cannot take
+// from the v1 piece list.
+func (t *Torrent) NumPieces() int {
+	if len(t.PieceHashes) > 0 {
+		return len(t.PieceHashes)
+	}
+	return (t.Length + t.PieceLength - 1) / t.PieceLength
+}
+
+// handshakeReserved returns the extension bits we advertise to peers
+func (t *Torrent) handshakeReserved() [8]byte {
+	var hs protocol.Handshake
+	hs.SetExtended()
+	if len(t.PieceRootsV2) > 0 {
+		hs.SetV2()
+	}
+	return hs.Reserved
+}
+
+// newPieceWork builds the work item for a piece with all known hashes
+func (t *Torrent) newPieceWork(index int) *pieceWork {
+	pw := &pieceWork{index: index, length: t.PieceSize(index)}
+	if len(t.PieceHashes) > 0 {
+		pw.hash = t.PieceHashes[index]
+		pw.hasV1 = true
+	}
+	if len(t.PieceRootsV2) > 0 {
+		pw.rootV2 = &t.PieceRootsV2[index]
+	}
+	return pw
+}
+
+// checkV2 verifies the file bytes of a piece against its merkle root. Pieces
+// made up only of padding have no root and always pass.
+func checkV2(pw *pieceWork, buf []byte) error {
+	root := pw.rootV2
+	if root.Length == 0 {
+		return nil
+	}
+	if root.Length > len(buf) {
+		return fmt.Errorf("piece %d shorter than its v2 length", pw.index)
+	}
+	if merkle.PieceRoot(buf[:root.Length], root.Leaves) != root.Root {
+		return fmt.Errorf("piece %d failed v2 integrity check", pw.index)
+	}
+	return nil
+}
+
+// handleHashRequest answers a BEP 52 hash request from the piece layers of
+// the torrent, rejecting requests for layers we do not hold.
+func (t *Torrent) handleHashRequest(c *peer.Client, msg *protocol.Message) error {
+	req, err := protocol.ParseHashRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	layer, ok := t.PieceLayers[req.PiecesRoot]
+	pieceLayer := merkle.Log2(t.PieceLength / merkle.BlockSize)
+	valid := ok && req.BaseLayer == pieceLayer && req.Length > 0 &&
+		req.Length == merkle.NextPow2(req.Length) && req.Index%req.Length == 0
+	if !valid {
+		return c.Send(protocol.FormatHashReject(req))
+	}
+
+	width := merkle.NextPow2(len(layer))
+	if req.Index+req.Length > width {
+		return c.Send(protocol.FormatHashReject(req))
+	}
+	layers := merkle.Layers(layer, width, merkle.PadHash(t.PieceLength/merkle.BlockSize))
+	base := layers[len(layers)-1]
+	hashes := append([][32]byte(nil), base[req.Index:req.Index+req.Length]...)
+	hashes = append(hashes, merkle.Proof(layers, req.Index, req.Length, req.ProofLayers)...)
+	return c.Send(protocol.FormatHashes(req, hashes))
+}
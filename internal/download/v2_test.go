@@ -0,0 +1,66 @@
+package download
+
+import (
+	"btc/internal/merkle"
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+func TestCheckV2(t *testing.T) {
+	// A 40000-byte file in a 64 KiB piece: three blocks, padded to four leaves
+	data := bytes.Repeat([]byte{7}, 40000)
+	buf := append(append([]byte(nil), data...), make([]byte, 65536-40000)...)
+	root := PieceRootV2{Root: merkle.PieceRoot(data, 4), Leaves: 4, Length: 40000}
+
+	corrupt := append([]byte(nil), buf...)
+	corrupt[39999] ^= 1
+	padTail := append([]byte(nil), buf...)
+	padTail[50000] = 1
+
+	tests := []struct {
+		name    string
+		root    PieceRootV2
+		buf     []byte
+		wantErr bool
+	}{
+		{"matching", root, buf, false},
+		{"file bytes only", root, data, false},
+		{"padding is not hashed", root, padTail, false},
+		{"corrupt byte", root, corrupt, true},
+		{"short buffer", root, data[:39999], true},
+		{"wrong leaf count", PieceRootV2{Root: root.Root, Leaves: 8, Length: 40000}, buf, true},
+		{"pad-only piece", PieceRootV2{}, corrupt, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkV2(&pieceWork{index: 1, rootV2: &tt.root}, tt.buf)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkV2 = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckIntegrityHybrid(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 20000)
+	pw := &pieceWork{
+		hash:   sha1.Sum(data),
+		hasV1:  true,
+		rootV2: &PieceRootV2{Root: merkle.PieceRoot(data, 2), Leaves: 2, Length: 20000},
+	}
+	if err := CheckIntegrity(pw, data); err != nil {
+		t.Errorf("valid piece failed: %v", err)
+	}
+
+	// Each hash is checked on its own
+	pw.rootV2.Root[0] ^= 1
+	if CheckIntegrity(pw, data) == nil {
+		t.Error("piece with a wrong v2 root passed")
+	}
+	pw.rootV2.Root[0] ^= 1
+	pw.hash[0] ^= 1
+	if CheckIntegrity(pw, data) == nil {
+		t.Error("piece with a wrong v1 hash passed")
+	}
+}
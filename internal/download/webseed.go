@@ -0,0 +1,84 @@
+package download
+
+import (
+	"btc/internal/logger"
+	"btc/internal/proxy"
+	"btc/internal/webseed"
+	"context"
+	"errors"
+	"time"
+)
+
+// newWebSeeds creates web seed clients for the torrent's url-list and httpseeds
+func (t *Torrent) newWebSeeds() []*webseed.Seed {
+	files := make([]webseed.File, 0, len(t.files()))
+	for _, f := range t.files() {
+		files = append(files, webseed.File{Path: f.Path, Length: f.Length, Pad: f.Pad})
+	}
+
+	if len(t.WebSeeds) == 0 && len(t.HTTPSeeds) == 0 {
+		return nil
+	}
+	client, err := proxy.HTTPClient(t.Cfg, proxy.WebSeeds, t.Cfg.WebSeedTimeout)
+	if err != nil {
+		logger.Warn("not using web seeds", "error", err)
+		return nil
+	}
+
+	var seeds []*webseed.Seed
+	for _, u := range t.WebSeeds {
+		seeds = append(seeds, webseed.New(u, webseed.GetRight, t.Name, files, t.MultiFile, t.PieceLength, t.InfoHash, client))
+	}
+	for _, u := range t.HTTPSeeds {
+		seeds = append(seeds, webseed.New(u, webseed.Hoffman, t.Name, files, t.MultiFile, t.PieceLength, t.InfoHash, client))
+	}
+	return seeds
+}
+
+// StartWebSeedWorker downloads pieces from an HTTP mirror. Failing mirrors are
+// retried with exponential backoff instead of being dropped.
+func (t *Torrent) StartWebSeedWorker(ctx context.Context, seed *webseed.Seed, results chan *pieceResult) {
+	backoff := time.Duration(0)
+	hasAll := func(int) bool { return true }
+	for {
+		if backoff > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-t.stopped:
+				return
+			}
+		}
+
+		pw := t.picker.next(hasAll)
+		if pw == nil {
+			return
+		}
+		buf, err := seed.FetchPiece(ctx, pw.index, pw.length)
+		if err == nil {
+			t.downloaded.Add(int64(len(buf)))
+			if err = CheckIntegrity(pw, buf); err != nil {
+				t.corrupt.Add(int64(len(buf)))
+			}
+		}
+		if err != nil {
+			t.picker.requeue(pw)
+			var retry *webseed.RetryError
+			if errors.As(err, &retry) {
+				backoff = retry.After
+			} else {
+				backoff = min(max(2*backoff, time.Second), t.Cfg.WebSeedMaxBackoff)
+			}
+			logger.Debug("web seed failed", "url", seed.URL, "piece", pw.index, "retry", backoff, "error", err)
+			t.emitEvent("webseed_failed", map[string]any{"url": seed.URL, "error": err.Error()})
+			continue
+		}
+		backoff = 0
+		t.reportBans(t.reputation.piecePassed(pw.index, buf, t.Cfg.BlockSize))
+
+		select {
+		case results <- &pieceResult{buf, pw.index}:
+		case <-t.stopped:
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package download
+
+import (
+	"btc/internal/config"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebSeedDownload(t *testing.T) {
+	const pieceLen = 16 * 1024
+	data := make([]byte, 3*pieceLen+100)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	var hashes [][20]byte
+	for i := 0; i < len(data); i += pieceLen {
+		hashes = append(hashes, sha1.Sum(data[i:min(i+pieceLen, len(data))]))
+	}
+
+	// The first two requests fail, the third gets corrupt data
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		n := len(times)
+		mu.Unlock()
+		switch n {
+		case 1, 2:
+			http.Error(w, "overloaded", http.StatusBadGateway)
+		case 3:
+			bad := bytes.Clone(data)
+			for i := range bad {
+				bad[i] ^= 0xff
+			}
+			http.ServeContent(w, r, "x.bin", time.Time{}, bytes.NewReader(bad))
+		default:
+			http.ServeContent(w, r, "x.bin", time.Time{}, bytes.NewReader(data))
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.Default()
+	cfg.EnableLSD = false
+	cfg.WebSeedMaxBackoff = 50 * time.Millisecond
+	tor := &Torrent{
+		PieceHashes: hashes,
+		Name:        "x.bin",
+		Length:      len(data),
+		PieceLength: pieceLen,
+		Files:       []File{{Path: "x.bin", Length: int64(len(data))}},
+		WebSeeds:    []string{srv.URL + "/x.bin"},
+		Cfg:         cfg,
+	}
+	out := filepath.Join(t.TempDir(), "x.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tor.Download(ctx, out); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded content differs from the web seed's")
+	}
+	if tor.corrupt.Load() != pieceLen {
+		t.Errorf("counted %d corrupt bytes, want %d", tor.corrupt.Load(), pieceLen)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i <= 3; i++ {
+		if gap := times[i].Sub(times[i-1]); gap < cfg.WebSeedMaxBackoff {
+			t.Errorf("retry %d came after %s, want a backoff of %s", i, gap, cfg.WebSeedMaxBackoff)
+		}
+	}
+}
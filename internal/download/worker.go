@@ -0,0 +1,486 @@
+package download
+
+import (
+	"btc/internal/logger"
+	"btc/internal/peer"
+	"btc/internal/protocol"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// activePiece is a piece being downloaded from one peer
+type activePiece struct {
+	pw         *pieceWork
+	buf        []byte
+	downloaded int // bytes present in buf
+	requested  int // offset of the next block to request
+}
+
+// blockRef identifies a block by piece index and offset
+type blockRef struct {
+	index, begin int
+}
+
+// blockRequest is an outstanding request
+type blockRequest struct {
+	length int
+	sent   time.Time
+}
+
+// worker downloads from one peer connection, keeping requests for several
+// pieces outstanding while the reader loop delivers messages
+type worker struct {
+	t        *Torrent
+	c        *peer.Client
+	results  chan *pieceResult
+	active   []*activePiece
+	requests map[blockRef]*blockRequest
+	pipe     *pipeline
+	stats    *peerState
+	done     bool // the picker is closed
+	// interested is what we last told the peer, peerInterested what it
+	// told us. idleSince is when both became false.
+	interested     bool
+	peerInterested bool
+	idleSince      time.Time
+}
+
+// StartWorker connects to p and downloads from it until the connection
+// ends. connected is called with our local address once the handshake
+// succeeds. It returns nil when the download no longer needs the peer.
+func (t *Torrent) StartWorker(ctx context.Context, p peer.Peer, source PeerSource, results chan *pieceResult, connected func(local net.Addr)) error {
+	if t.IsBanned(p.IP.String()) {
+		return errBanned
+	}
+	if !t.PeerAllowed(p.IP) {
+		return errBlocked
+	}
+	c, err := peer.New(p, t.PeerID, t.InfoHash, t.handshakeReserved(), t.messageLimits(), t.Cfg)
+	if err != nil {
+		logger.Debug("handshake failed", "peer", p.IP.String(), "error", err)
+		t.emitEvent("handshake_failed", map[string]any{"peer": p.IP.String(), "error": err.Error()})
+		return err
+	}
+	defer c.Close()
+	logger.Debug("handshake successful", "peer", p.IP.String(), "client", c.Info.String())
+	t.emitEvent("handshake_success", map[string]any{"peer": p.IP.String(), "client": c.Info.String()})
+	connected(c.Conn.LocalAddr())
+	return t.runWorker(ctx, c, source, results)
+}
+
+// messageLimits describes the torrent for validating peer messages
+func (t *Torrent) messageLimits() *protocol.Limits {
+	return &protocol.Limits{NumPieces: t.NumPieces(), PieceSize: t.PieceSize}
+}
+
+// runWorker downloads from an established connection until it ends
+func (t *Torrent) runWorker(ctx context.Context, c *peer.Client, source PeerSource, results chan *pieceResult) error {
+	p := c.Peer
+	ps, untrack := t.trackPeer(PeerStats{
+		Addr:         p.String(),
+		Client:       c.Info.String(),
+		Source:       source,
+		ConnectedAt:  time.Now(),
+		PeerChoking:  true,
+		AmInterested: true,
+	})
+	defer untrack()
+
+	w := &worker{
+		t:        t,
+		c:        c,
+		results:  results,
+		requests: make(map[blockRef]*blockRequest),
+		pipe:     newPipeline(t.Cfg),
+		stats:    ps,
+	}
+	defer w.release()
+	err := w.run(ctx)
+	if errors.Is(err, errStopped) {
+		return nil
+	}
+	var violation *protocol.ProtocolError
+	if errors.As(err, &violation) {
+		logger.Info("disconnecting peer for protocol violation", "peer", p.IP.String(), "client", c.Info.String(), "error", err)
+		t.emitEvent("protocol_violation", map[string]any{"peer": p.IP.String(), "error": err.Error()})
+	} else if err != nil {
+		logger.Debug("peer connection ended", "peer", p.IP.String(), "error", err)
+	}
+	return err
+}
+
+func (w *worker) run(ctx context.Context) error {
+	w.c.SendUnchoke()
+	w.c.SendInterested()
+	w.interested = true
+
+	// stall fires when outstanding requests see no block for PieceTimeout
+	stall := time.NewTimer(w.t.Cfg.PieceTimeout)
+	defer stall.Stop()
+	// tick checks for requests that timed out and idle connections
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		hadBacklog := len(w.requests) > 0
+		if err := w.fillRequests(); err != nil {
+			return err
+		}
+		if w.done && len(w.active) == 0 {
+			return nil
+		}
+		requests := len(w.requests)
+		w.stats.update(func(s *PeerStats) { s.Requests = requests })
+		if !hadBacklog && len(w.requests) > 0 {
+			stall.Reset(w.t.Cfg.PieceTimeout)
+		}
+
+		// Only wait for new work when there is room to request it
+		var changed <-chan struct{}
+		if !w.c.Choke && !w.done && len(w.requests) < w.pipe.target(w.c.Reqq) {
+			changed = w.t.picker.changed()
+		}
+		var stalled <-chan time.Time
+		if len(w.requests) > 0 {
+			stalled = stall.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.t.stopped:
+			return nil
+		case <-changed:
+		case <-stalled:
+			return fmt.Errorf("no block received for %s", w.t.Cfg.PieceTimeout)
+		case <-tick.C:
+			// Another connection may have got this peer banned, or the
+			// IP filter been reloaded
+			if err := w.checkBanned(); err != nil {
+				return err
+			}
+			if err := w.reissueExpired(); err != nil {
+				return err
+			}
+			if err := w.checkIdle(time.Now()); err != nil {
+				return err
+			}
+		case msg, ok := <-w.c.Messages():
+			if !ok {
+				return w.c.Err()
+			}
+			progressed, err := w.handle(msg)
+			msg.Release()
+			if err != nil {
+				return err
+			}
+			if progressed {
+				stall.Reset(w.t.Cfg.PieceTimeout)
+			}
+		}
+	}
+}
+
+// reissueExpired cancels requests the peer has not answered in time and
+// asks for the same blocks again, rather than giving up on their pieces
+func (w *worker) reissueExpired() error {
+	timeout := w.pipe.timeout()
+	now := time.Now()
+	for ref, req := range w.requests {
+		if now.Sub(req.sent) < timeout {
+			continue
+		}
+		logger.Debug("request timed out", "peer", w.c.Peer.String(), "piece", ref.index, "begin", ref.begin)
+		if err := w.c.SendCancel(ref.index, ref.begin, req.length); err != nil {
+			return err
+		}
+		if err := w.c.SendRequest(ref.index, ref.begin, req.length); err != nil {
+			return err
+		}
+		req.sent = now
+	}
+	return nil
+}
+
+// errIdle ends a connection that neither side needs
+var errIdle = errors.New("peer idle")
+
+// checkIdle keeps our interest in the peer up to date and ends the
+// connection once neither side has been interested for PeerIdleTimeout
+func (w *worker) checkIdle(now time.Time) error {
+	interesting := len(w.active) > 0 || (!w.done && w.t.picker.wants(w.c.Bitfield.HasPiece))
+	if interesting != w.interested {
+		var err error
+		if interesting {
+			err = w.c.SendInterested()
+		} else {
+			err = w.c.SendNotInterested()
+		}
+		if err != nil {
+			return err
+		}
+		w.interested = interesting
+		w.stats.update(func(s *PeerStats) { s.AmInterested = interesting })
+	}
+
+	if interesting || w.peerInterested || w.t.Cfg.PeerIdleTimeout <= 0 {
+		w.idleSince = time.Time{}
+		return nil
+	}
+	if w.idleSince.IsZero() {
+		w.idleSince = now
+		return nil
+	}
+	if now.Sub(w.idleSince) >= w.t.Cfg.PeerIdleTimeout {
+		return fmt.Errorf("neither side interested for %s: %w", w.t.Cfg.PeerIdleTimeout, errIdle)
+	}
+	return nil
+}
+
+// release hands unfinished pieces back to the picker. Blocks already
+// written stay on disk for whoever picks them up next.
+func (w *worker) release() {
+	for _, ap := range w.active {
+		w.t.picker.requeue(ap.pw)
+	}
+	w.active = nil
+}
+
+// fillRequests keeps as many block requests outstanding as the pipeline
+// wants, starting new pieces once the active ones are fully requested
+func (w *worker) fillRequests() error {
+	target := w.pipe.target(w.c.Reqq)
+	for !w.c.Choke && len(w.requests) < target {
+		ap := w.nextToRequest()
+		if ap == nil {
+			if w.done {
+				return nil
+			}
+			pw, ok := w.t.picker.tryNext(w.c.Bitfield.HasPiece)
+			if !ok {
+				w.done = true
+				return nil
+			}
+			if pw == nil {
+				return nil
+			}
+			if err := w.start(pw); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ref := blockRef{ap.pw.index, ap.requested}
+		length := min(w.t.Cfg.BlockSize, ap.pw.length-ref.begin)
+		ap.requested += length
+		if w.t.blocks.hasBlock(ref.index, ref.begin) || w.requests[ref] != nil {
+			continue
+		}
+		// Fails while an earlier copy is arriving, which will do instead
+		if !w.c.Blocks.Register(ref.index, ref.begin, ap.buf[ref.begin:ref.begin+length]) {
+			continue
+		}
+		if err := w.c.SendRequest(ref.index, ref.begin, length); err != nil {
+			return fmt.Errorf("sending request for piece %d: %w", ref.index, err)
+		}
+		w.requests[ref] = &blockRequest{length: length, sent: time.Now()}
+	}
+	return nil
+}
+
+func (w *worker) nextToRequest() *activePiece {
+	for _, ap := range w.active {
+		if ap.requested < ap.pw.length {
+			return ap
+		}
+	}
+	return nil
+}
+
+// start makes pw active, loading blocks persisted by an earlier attempt or run
+func (w *worker) start(pw *pieceWork) error {
+	t := w.t
+	ap := &activePiece{pw: pw, buf: make([]byte, pw.length)}
+	for begin := 0; begin < pw.length; begin += t.Cfg.BlockSize {
+		if !t.blocks.hasBlock(pw.index, begin) {
+			continue
+		}
+		end := min(begin+t.Cfg.BlockSize, pw.length)
+		if err := t.storage.ReadBlock(pw.index, begin, ap.buf[begin:end]); err != nil {
+			t.blocks.resetPiece(pw.index)
+			ap.downloaded = 0
+			break
+		}
+		ap.downloaded += end - begin
+	}
+	w.active = append(w.active, ap)
+	if ap.downloaded == pw.length {
+		return w.finish(ap)
+	}
+	return nil
+}
+
+// handle processes one message, reporting whether it delivered a block
+func (w *worker) handle(msg *protocol.Message) (bool, error) {
+	if msg == nil {
+		return false, nil // keep-alive
+	}
+	switch msg.ID {
+	case protocol.MsgUnchoke:
+		w.c.Choke = false
+		w.stats.update(func(s *PeerStats) { s.PeerChoking = false })
+	case protocol.MsgInterested, protocol.MsgUnInterested:
+		interested := msg.ID == protocol.MsgInterested
+		w.peerInterested = interested
+		w.stats.update(func(s *PeerStats) { s.PeerInterested = interested })
+	case protocol.MsgChoke:
+		// The peer drops our queued requests. Hand our pieces back so
+		// other peers can finish them, fresh ones are started after the
+		// unchoke.
+		w.c.Choke = true
+		w.stats.update(func(s *PeerStats) { s.PeerChoking = true })
+		clear(w.requests)
+		w.c.Blocks.DropUnclaimed()
+		w.release()
+	case protocol.MsgHave:
+		index, err := protocol.ParseHave(msg)
+		if err != nil {
+			return false, err
+		}
+		w.c.Bitfield.SetPiece(index)
+	case protocol.MsgExtended:
+		if err := w.c.HandleExtended(msg); err != nil {
+			logger.Debug("bad extended message", "peer", w.c.Peer.String(), "error", err)
+		}
+		client := w.c.Info.String()
+		w.stats.update(func(s *PeerStats) { s.Client = client })
+	case protocol.MsgHashRequest:
+		return false, w.t.handleHashRequest(w.c, msg)
+	case protocol.MsgHashes, protocol.MsgHashReject:
+		// Piece layers come from the metainfo, we never request hashes
+		logger.Debug("ignoring unsolicited hash message", "type", msg.String())
+	case protocol.MsgPiece:
+		return true, w.receiveBlock(msg)
+	}
+	return false, nil
+}
+
+func (w *worker) receiveBlock(msg *protocol.Message) error {
+	if len(msg.Payload) < 8 {
+		return fmt.Errorf("piece message too short: %d", len(msg.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	data := msg.BlockData()
+	ref := blockRef{index, begin}
+	if req, ok := w.requests[ref]; ok {
+		w.pipe.sample(time.Since(req.sent), len(data))
+		delete(w.requests, ref)
+	}
+	redundant := func() {
+		n := int64(len(data))
+		w.stats.update(func(s *PeerStats) { s.Downloaded += n })
+		w.t.downloaded.Add(n)
+		w.t.redundant.Add(n)
+	}
+	if msg.Block != nil {
+		w.c.Blocks.Delivered(index, begin)
+	} else if !w.c.Blocks.Take(index, begin) {
+		// The reader loop is filling this block from another copy
+		redundant()
+		return nil
+	}
+
+	var ap *activePiece
+	for _, candidate := range w.active {
+		if candidate.pw.index == index {
+			ap = candidate
+			break
+		}
+	}
+	if ap == nil || w.t.blocks.hasBlock(index, begin) {
+		// Late block of a piece we no longer work on, or one we have
+		redundant()
+		return nil
+	}
+	if want := min(w.t.Cfg.BlockSize, ap.pw.length-begin); begin%w.t.Cfg.BlockSize != 0 || len(data) != want {
+		return &protocol.ProtocolError{
+			Message: "Piece",
+			Reason:  fmt.Sprintf("block %d+%d of piece %d was not requested", begin, len(data), index),
+		}
+	}
+
+	n, err := protocol.ParsePiece(index, ap.buf, msg)
+	if err != nil {
+		return err
+	}
+	err = w.t.storage.WriteBlock(index, begin, ap.buf[begin:begin+n])
+	if err != nil {
+		return fmt.Errorf("writing block %d of piece %d: %w", begin, index, err)
+	}
+	w.t.downloaded.Add(int64(n))
+	w.stats.rate.Add(int64(n))
+	w.stats.update(func(s *PeerStats) { s.Downloaded += int64(n) })
+	if !w.t.blocks.markBlock(index, begin) {
+		w.t.redundant.Add(int64(n))
+		return nil
+	}
+	w.t.reputation.recordBlock(index, begin/w.t.Cfg.BlockSize, w.t.blocks.numBlocks(index), w.c.Peer.IP.String())
+	ap.downloaded += n
+	if ap.downloaded < ap.pw.length {
+		return nil
+	}
+	return w.finish(ap)
+}
+
+// errBanned ends the connection to a banned peer
+var errBanned = errors.New("peer is banned")
+
+// errBlocked ends the connection to a peer the IP filter blocks
+var errBlocked = errors.New("peer blocked by IP filter")
+
+func (w *worker) checkBanned() error {
+	if w.t.IsBanned(w.c.Peer.IP.String()) {
+		return errBanned
+	}
+	if !w.t.PeerAllowed(w.c.Peer.IP) {
+		return errBlocked
+	}
+	return nil
+}
+
+// errStopped ends a worker whose download has finished or been cancelled
+var errStopped = errors.New("download stopped")
+
+// finish verifies a complete piece and hands it to the download loop
+func (w *worker) finish(ap *activePiece) error {
+	for i, candidate := range w.active {
+		if candidate == ap {
+			w.active = append(w.active[:i], w.active[i+1:]...)
+			break
+		}
+	}
+
+	pw := ap.pw
+	if err := CheckIntegrity(pw, ap.buf); err != nil {
+		logger.Debug("integrity check failed", "piece", pw.index)
+		w.t.corrupt.Add(int64(pw.length))
+		w.stats.update(func(s *PeerStats) { s.HashFailures++ })
+		w.t.reportBans(w.t.reputation.pieceFailed(pw.index, ap.buf, w.t.Cfg.BlockSize))
+		w.t.blocks.resetPiece(pw.index)
+		w.t.picker.requeue(pw)
+		return w.checkBanned()
+	}
+	w.t.reportBans(w.t.reputation.piecePassed(pw.index, ap.buf, w.t.Cfg.BlockSize))
+	w.stats.update(func(s *PeerStats) { s.PiecesReceived++ })
+	w.c.SendHave(pw.index)
+	select {
+	case w.results <- &pieceResult{ap.buf, pw.index}:
+		return nil
+	case <-w.t.stopped:
+		return errStopped
+	}
+}
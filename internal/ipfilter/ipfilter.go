@@ -0,0 +1,247 @@
+package ipfilter
+
+import (
+	"btc/internal/logger"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// eMule access levels below this value block their range
+const emuleBlockLevel = 128
+
+// Range is an inclusive range of blocked addresses of one family
+type Range struct {
+	From, To netip.Addr
+}
+
+// Filter blocks peers whose address falls in one of its ranges. It can be
+// reloaded while in use.
+type Filter struct {
+	path   string
+	mu     sync.RWMutex
+	ranges []Range // sorted and merged
+}
+
+// New creates a filter blocking the given ranges
+func New(ranges []Range) *Filter {
+	f := &Filter{}
+	f.set(ranges)
+	return f
+}
+
+// Load creates a filter from a blocklist file, see Parse for the formats
+func Load(path string) (*Filter, error) {
+	f := &Filter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the blocklist file again. The old ranges stay in effect if
+// it cannot be read.
+func (f *Filter) Reload() error {
+	if f.path == "" {
+		return fmt.Errorf("filter was not loaded from a file")
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("opening IP filter: %w", err)
+	}
+	defer file.Close()
+
+	ranges, skipped, err := Parse(file)
+	if err != nil {
+		return fmt.Errorf("reading IP filter %s: %w", f.path, err)
+	}
+	if skipped > 0 {
+		logger.Warn("skipped unreadable IP filter lines", "path", f.path, "lines", skipped)
+	}
+	f.set(ranges)
+	logger.Info("IP filter loaded", "path", f.path, "ranges", f.Len())
+	return nil
+}
+
+func (f *Filter) set(ranges []Range) {
+	merged := merge(ranges)
+	f.mu.Lock()
+	f.ranges = merged
+	f.mu.Unlock()
+}
+
+// Len returns the number of distinct blocked ranges
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.ranges)
+}
+
+// Contains reports whether ip is in a blocked range
+func (f *Filter) Contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	// The first range ending at or after addr is the only candidate
+	i, _ := slices.BinarySearchFunc(f.ranges, addr, func(r Range, a netip.Addr) int {
+		return r.To.Compare(a)
+	})
+	return i < len(f.ranges) && f.ranges[i].From.Compare(addr) <= 0
+}
+
+// merge sorts ranges and joins those that overlap or touch
+func merge(ranges []Range) []Range {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b Range) int {
+		return cmp.Or(a.From.Compare(b.From), a.To.Compare(b.To))
+	})
+	var out []Range
+	for _, r := range sorted {
+		if n := len(out); n > 0 && out[n-1].From.Is4() == r.From.Is4() {
+			last := &out[n-1]
+			if next := last.To.Next(); !next.IsValid() || r.From.Compare(next) <= 0 {
+				if r.To.Compare(last.To) > 0 {
+					last.To = r.To
+				}
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// Parse reads a blocklist, optionally gzipped, with one entry per line in
+// any of these formats:
+//
+//	eMule ipfilter.dat:  001.002.003.000 - 001.002.003.255 , 000 , Description
+//	PeerGuardian P2P:    Description:1.2.3.0-1.2.3.255
+//	plain:               1.2.3.0/24, 1.2.3.4-1.2.3.9 or 1.2.3.4
+//
+// Blank lines and comments starting with # or // are ignored. eMule
+// entries with an access level of 128 or more allow their range and are
+// skipped. It returns how many lines could not be understood.
+func Parse(r io.Reader) (ranges []Range, skipped int, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, block, ok := parseLine(line)
+		if !ok {
+			skipped++
+			continue
+		}
+		if block {
+			ranges = append(ranges, rng)
+		}
+	}
+	return ranges, skipped, scanner.Err()
+}
+
+// parseLine parses one entry. block is false for eMule entries that allow
+// their range.
+func parseLine(line string) (rng Range, block, ok bool) {
+	if prefix, err := netip.ParsePrefix(line); err == nil {
+		prefix = prefix.Masked()
+		return Range{prefix.Addr(), lastAddr(prefix)}, true, true
+	}
+	if addr, ok := parseAddr(line); ok {
+		return Range{addr, addr}, true, true
+	}
+
+	// eMule: range , level , description
+	if fields := strings.SplitN(line, ",", 3); len(fields) >= 2 {
+		rng, ok := parseRange(fields[0])
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if ok && err == nil {
+			return rng, level < emuleBlockLevel, true
+		}
+	}
+
+	if rng, ok := parseRange(line); ok {
+		return rng, true, true
+	}
+	// P2P: the description may itself contain colons
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if rng, ok := parseRange(line[i+1:]); ok {
+			return rng, true, true
+		}
+	}
+	return Range{}, false, false
+}
+
+// parseRange parses "from - to" with addresses of the same family
+func parseRange(s string) (Range, bool) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		return Range{}, false
+	}
+	a, ok1 := parseAddr(from)
+	b, ok2 := parseAddr(to)
+	if !ok1 || !ok2 || a.Is4() != b.Is4() {
+		return Range{}, false
+	}
+	if b.Less(a) {
+		a, b = b, a
+	}
+	return Range{a, b}, true
+}
+
+// parseAddr parses an address, accepting the zero padded IPv4 octets of
+// eMule lists
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, false
+	}
+	var ip [4]byte
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip[i] = byte(n)
+	}
+	return netip.AddrFrom4(ip), true
+}
+
+// lastAddr returns the highest address of a masked prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for bit := p.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 1 << (7 - bit%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,207 @@
+package ipfilter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func rng(from, to string) Range {
+	return Range{netip.MustParseAddr(from), netip.MustParseAddr(to)}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []Range
+		skipped int
+	}{
+		{
+			name:  "emule",
+			input: "001.002.003.000 - 001.002.003.255 , 000 , Some org\n010.000.000.001 - 010.000.000.009 , 127 , Other",
+			want:  []Range{rng("1.2.3.0", "1.2.3.255"), rng("10.0.0.1", "10.0.0.9")},
+		},
+		{
+			name:  "emule allow level",
+			input: "001.002.003.000 - 001.002.003.255 , 128 , Allowed\n005.000.000.000 - 005.000.000.010 , 200 , Allowed",
+		},
+		{
+			name:  "p2p",
+			input: "Some org:1.2.3.0-1.2.3.255\nA: description: with colons:4.0.0.0-4.0.0.255",
+			want:  []Range{rng("1.2.3.0", "1.2.3.255"), rng("4.0.0.0", "4.0.0.255")},
+		},
+		{
+			name:  "cidr",
+			input: "1.2.3.77/24\n2001:db8::/32",
+			want:  []Range{rng("1.2.3.0", "1.2.3.255"), rng("2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff")},
+		},
+		{
+			name:  "plain addresses and ranges",
+			input: "1.2.3.4\n1.2.3.9 - 1.2.3.5\n::ffff:5.6.7.8\n2001:db8::1-2001:db8::ff",
+			want: []Range{
+				rng("1.2.3.4", "1.2.3.4"), rng("1.2.3.5", "1.2.3.9"),
+				rng("5.6.7.8", "5.6.7.8"), rng("2001:db8::1", "2001:db8::ff"),
+			},
+		},
+		{
+			name:  "comments and blank lines",
+			input: "# comment\n\n   \n// another\n  1.2.3.4  \n",
+			want:  []Range{rng("1.2.3.4", "1.2.3.4")},
+		},
+		{
+			name:    "invalid lines",
+			input:   "garbage\n1.2.3.256\n1.2.3.4-::1\nname:\n300.0.0.0 - 300.0.0.1 , 0 , x\n1.2.3.4",
+			want:    []Range{rng("1.2.3.4", "1.2.3.4")},
+			skipped: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped, err := Parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ranges = %v, want %v", got, tt.want)
+			}
+			if skipped != tt.skipped {
+				t.Errorf("skipped %d lines, want %d", skipped, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestParseGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("Some org:1.2.3.0-1.2.3.255\n"))
+	gz.Close()
+
+	got, _, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Range{rng("1.2.3.0", "1.2.3.255")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ranges = %v, want %v", got, want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []Range
+		want []Range
+	}{
+		{
+			name: "overlapping",
+			in:   []Range{rng("1.0.0.50", "1.0.0.200"), rng("1.0.0.0", "1.0.0.100")},
+			want: []Range{rng("1.0.0.0", "1.0.0.200")},
+		},
+		{
+			name: "contained",
+			in:   []Range{rng("1.0.0.0", "1.0.0.255"), rng("1.0.0.5", "1.0.0.6")},
+			want: []Range{rng("1.0.0.0", "1.0.0.255")},
+		},
+		{
+			name: "adjacent",
+			in:   []Range{rng("1.0.1.0", "1.0.1.255"), rng("1.0.0.0", "1.0.0.255")},
+			want: []Range{rng("1.0.0.0", "1.0.1.255")},
+		},
+		{
+			name: "gap of one address",
+			in:   []Range{rng("1.0.0.0", "1.0.0.9"), rng("1.0.0.11", "1.0.0.20")},
+			want: []Range{rng("1.0.0.0", "1.0.0.9"), rng("1.0.0.11", "1.0.0.20")},
+		},
+		{
+			name: "families stay apart",
+			in:   []Range{rng("::", "::ffff"), rng("0.0.0.0", "255.255.255.255"), rng("::1", "::2")},
+			want: []Range{rng("0.0.0.0", "255.255.255.255"), rng("::", "::ffff")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := merge(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merge = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContains(t *testing.T) {
+	f := New([]Range{
+		rng("1.2.3.0", "1.2.3.255"),
+		rng("10.0.0.5", "10.0.0.5"),
+		rng("200.0.0.0", "255.255.255.255"),
+		rng("2001:db8::", "2001:db8::ffff"),
+	})
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.2.2.255", false},
+		{"1.2.3.0", true},
+		{"1.2.3.128", true},
+		{"1.2.3.255", true},
+		{"1.2.4.0", false},
+		{"10.0.0.4", false},
+		{"10.0.0.5", true},
+		{"10.0.0.6", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", true},
+		{"::ffff:1.2.3.4", true},
+		{"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff", false},
+		{"2001:db8::", true},
+		{"2001:db8::ffff", true},
+		{"2001:db8::1:0", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if got := f.Contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if f.Contains(nil) {
+		t.Error("Contains(nil) = true")
+	}
+	if New(nil).Contains(net.ParseIP("1.2.3.4")) {
+		t.Error("empty filter blocks an address")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte("1.2.3.4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Contains(net.ParseIP("1.2.3.4")) {
+		t.Fatal("loaded filter does not block its address")
+	}
+
+	os.WriteFile(path, []byte("5.6.7.8\n"), 0o644)
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Contains(net.ParseIP("1.2.3.4")) || !f.Contains(net.ParseIP("5.6.7.8")) {
+		t.Error("reload did not replace the ranges")
+	}
+
+	// A missing file keeps the old ranges
+	os.Remove(path)
+	if err := f.Reload(); err == nil {
+		t.Error("reloading a missing file succeeded")
+	}
+	if !f.Contains(net.ParseIP("5.6.7.8")) {
+		t.Error("failed reload dropped the old ranges")
+	}
+}
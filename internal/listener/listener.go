@@ -0,0 +1,111 @@
+// Package listener accepts incoming peer connections and hands them to the
+// download they ask for by info hash.
+package listener
+
+import (
+	"btc/internal/config"
+	"btc/internal/download"
+	"btc/internal/logger"
+	"btc/internal/protocol"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Listener accepts peer connections on a TCP port
+type Listener struct {
+	ln       net.Listener
+	cfg      *config.Config
+	mu       sync.Mutex
+	torrents map[[20]byte]*download.Torrent
+}
+
+// New listens for peer connections on port, or on any free port when port
+// is 0
+func New(port uint16, cfg *config.Config) (*Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, fmt.Errorf("listening for peers: %w", err)
+	}
+	return &Listener{
+		ln:       ln,
+		cfg:      cfg,
+		torrents: make(map[[20]byte]*download.Torrent),
+	}, nil
+}
+
+// Port returns the port connections are accepted on
+func (l *Listener) Port() uint16 {
+	return uint16(l.ln.Addr().(*net.TCPAddr).Port)
+}
+
+// Add accepts connections for t under each of its info hashes
+func (l *Listener) Add(t *download.Torrent) {
+	l.mu.Lock()
+	for _, infoHash := range t.InfoHashes() {
+		l.torrents[infoHash] = t
+	}
+	l.mu.Unlock()
+}
+
+// Remove stops accepting connections for t
+func (l *Listener) Remove(t *download.Torrent) {
+	l.mu.Lock()
+	for _, infoHash := range t.InfoHashes() {
+		delete(l.torrents, infoHash)
+	}
+	l.mu.Unlock()
+}
+
+// Run accepts connections until ctx is done
+func (l *Listener) Run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		l.ln.Close()
+	}()
+	logger.Info("accepting peer connections", "port", l.Port())
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logger.Debug("accepting peer connection failed", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go l.handle(conn)
+	}
+}
+
+// handle reads the handshake of an incoming connection and passes the
+// connection to the download for its info hash
+func (l *Listener) handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(l.cfg.HandshakeTimeout))
+	hs, err := protocol.ReadHandshake(conn)
+	if err != nil {
+		logger.Debug("reading incoming handshake failed", "peer", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	l.mu.Lock()
+	t, ok := l.torrents[hs.InfoHash]
+	l.mu.Unlock()
+	if !ok {
+		logger.Debug("incoming peer asked for an unknown torrent", "peer", conn.RemoteAddr().String())
+		return
+	}
+	if err := t.AcceptPeer(conn, hs); err != nil {
+		logger.Debug("incoming peer connection ended", "peer", conn.RemoteAddr().String(), "error", err)
+	}
+}
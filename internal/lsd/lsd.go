@@ -0,0 +1,263 @@
+// Package lsd implements Local Service Discovery (BEP 14), finding peers on
+// the local network through multicast announcements.
+package lsd
+
+import (
+	"btc/internal/logger"
+	"btc/internal/peer"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Port is the multicast port used by LSD
+const Port = 6771
+
+const (
+	announceInterval = 5 * time.Minute
+	// minInterval limits how often an info hash is announced, and how often
+	// announcements from the same host for the same hash are accepted
+	minInterval    = time.Minute
+	maxMessageSize = 1400
+)
+
+var (
+	groupV4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: Port}
+	groupV6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: Port}
+)
+
+// PeersFunc receives peers announced on the local network
+type PeersFunc func(peers []peer.Peer)
+
+type torrent struct {
+	onPeers  PeersFunc
+	lastSent time.Time
+}
+
+type groupConn struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+}
+
+// Service announces info hashes on the LAN and reports peers announcing the same
+type Service struct {
+	port     int
+	cookie   string
+	conns    []groupConn
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+	seen     map[string]time.Time
+}
+
+// New joins the LSD multicast groups. port is the port we accept peer
+// connections on. It fails only if neither IPv4 nor IPv6 is usable.
+func New(port int) (*Service, error) {
+	var cookie [8]byte
+	if _, err := rand.Read(cookie[:]); err != nil {
+		return nil, fmt.Errorf("generating lsd cookie: %w", err)
+	}
+	s := &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie[:]),
+		torrents: make(map[[20]byte]*torrent),
+		seen:     make(map[string]time.Time),
+	}
+	for _, g := range []struct {
+		network string
+		addr    *net.UDPAddr
+	}{{"udp4", groupV4}, {"udp6", groupV6}} {
+		conn, err := net.ListenMulticastUDP(g.network, nil, g.addr)
+		if err != nil {
+			logger.Debug("lsd group unavailable", "group", g.addr.String(), "error", err)
+			continue
+		}
+		s.conns = append(s.conns, groupConn{conn, g.addr})
+	}
+	if len(s.conns) == 0 {
+		return nil, errors.New("lsd: no multicast group could be joined")
+	}
+	return s, nil
+}
+
+// Add starts announcing infoHash, passing peers found for it to onPeers
+func (s *Service) Add(infoHash [20]byte, onPeers PeersFunc) {
+	s.mu.Lock()
+	s.torrents[infoHash] = &torrent{onPeers: onPeers}
+	s.mu.Unlock()
+	s.announce(infoHash)
+}
+
+// Remove stops announcing infoHash
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+}
+
+// Run listens for announcements and re-announces periodically until ctx is done
+func (s *Service) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, gc := range s.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.listen(gc.conn)
+		}()
+	}
+
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for _, gc := range s.conns {
+				gc.conn.Close()
+			}
+			wg.Wait()
+			return ctx.Err()
+		case <-ticker.C:
+			s.mu.Lock()
+			hashes := make([][20]byte, 0, len(s.torrents))
+			for h := range s.torrents {
+				hashes = append(hashes, h)
+			}
+			s.mu.Unlock()
+			for _, h := range hashes {
+				s.announce(h)
+			}
+		}
+	}
+}
+
+// announce multicasts infoHash unless it was announced within minInterval
+func (s *Service) announce(infoHash [20]byte) {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	if !ok || time.Since(t.lastSent) < minInterval {
+		s.mu.Unlock()
+		return
+	}
+	t.lastSent = time.Now()
+	s.mu.Unlock()
+
+	for _, gc := range s.conns {
+		msg := formatSearch(gc.group, s.port, infoHash, s.cookie)
+		if _, err := gc.conn.WriteToUDP(msg, gc.group); err != nil {
+			logger.Debug("lsd announce failed", "group", gc.group.String(), "error", err)
+		}
+	}
+}
+
+func (s *Service) listen(conn *net.UDPConn) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Debug("lsd read failed", "error", err)
+			}
+			return
+		}
+		msg, err := parseSearch(buf[:n])
+		if err != nil {
+			logger.Debug("ignoring lsd message", "from", src.String(), "error", err)
+			continue
+		}
+		if msg.cookie == s.cookie {
+			continue // our own announcement looped back
+		}
+		s.handle(src.IP, msg)
+	}
+}
+
+func (s *Service) handle(ip net.IP, msg *search) {
+	p := peer.Peer{IP: ip, Port: msg.port}
+	now := time.Now()
+	for _, h := range msg.infoHashes {
+		key := ip.String() + "/" + hex.EncodeToString(h[:])
+		s.mu.Lock()
+		t, ok := s.torrents[h]
+		if ok && now.Sub(s.seen[key]) < minInterval {
+			ok = false
+		}
+		if ok {
+			s.seen[key] = now
+		}
+		for k, at := range s.seen {
+			if now.Sub(at) >= minInterval {
+				delete(s.seen, k)
+			}
+		}
+		s.mu.Unlock()
+		if ok {
+			logger.Debug("lsd peer found", "peer", p.String())
+			t.onPeers([]peer.Peer{p})
+		}
+	}
+}
+
+type search struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+func formatSearch(group *net.UDPAddr, port int, infoHash [20]byte, cookie string) []byte {
+	var b bytes.Buffer
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", group.String())
+	fmt.Fprintf(&b, "Port: %d\r\n", port)
+	fmt.Fprintf(&b, "Infohash: %s\r\n", hex.EncodeToString(infoHash[:]))
+	fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+func parseSearch(data []byte) (*search, error) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	if !sc.Scan() || strings.TrimSpace(sc.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return nil, errors.New("not a BT-SEARCH request")
+	}
+
+	msg := &search{}
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			msg.port = uint16(port)
+		case "infohash":
+			raw, err := hex.DecodeString(value)
+			if err != nil || len(raw) != 20 {
+				return nil, fmt.Errorf("invalid infohash %q", value)
+			}
+			msg.infoHashes = append(msg.infoHashes, [20]byte(raw))
+		case "cookie":
+			msg.cookie = value
+		}
+	}
+	if msg.port == 0 || len(msg.infoHashes) == 0 {
+		return nil, errors.New("missing port or infohash")
+	}
+	return msg, nil
+}
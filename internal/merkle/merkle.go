@@ -0,0 +1,100 @@
+// Package merkle implements the SHA-256 merkle trees of BitTorrent v2 (BEP 52).
+package merkle
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// BlockSize is the size of the data covered by one leaf hash
+const BlockSize = 16 * 1024
+
+// Hash is a SHA-256 node of the tree
+type Hash = [32]byte
+
+// NextPow2 returns the smallest power of two >= n (1 for n <= 1)
+func NextPow2(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// Log2 returns log2 of a power of two
+func Log2(n int) int {
+	return bits.TrailingZeros(uint(n))
+}
+
+// PadHash returns the root of an all-padding subtree with the given number
+// of leaves. Padding leaves are all-zero hashes.
+func PadHash(leaves int) Hash {
+	var h Hash
+	for n := 1; n < leaves; n *= 2 {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+func hashPair(a, b Hash) Hash {
+	var buf [64]byte
+	copy(buf[:32], a[:])
+	copy(buf[32:], b[:])
+	return sha256.Sum256(buf[:])
+}
+
+// BlockHashes hashes data in BlockSize leaves, the last one may be short
+func BlockHashes(data []byte) []Hash {
+	leaves := make([]Hash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		leaves = append(leaves, sha256.Sum256(data[begin:min(begin+BlockSize, len(data))]))
+	}
+	return leaves
+}
+
+// Root computes the root over nodes, padded to width nodes with padding
+// subtree roots of the same layer. width must be a power of two >= len(nodes).
+func Root(nodes []Hash, width int, pad Hash) Hash {
+	return Layers(nodes, width, pad)[0][0]
+}
+
+// Layers builds every layer from nodes (the base layer, padded to width)
+// up to the root. The returned slice is indexed from the root down, so
+// Layers(...)[0] holds the root and the last entry holds the padded base.
+func Layers(nodes []Hash, width int, pad Hash) [][]Hash {
+	layer := make([]Hash, width)
+	copy(layer, nodes)
+	for i := len(nodes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	layers := [][]Hash{layer}
+	for len(layer) > 1 {
+		next := make([]Hash, len(layer)/2)
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layers = append([][]Hash{next}, layers...)
+		layer = next
+	}
+	return layers
+}
+
+// PieceRoot computes the root of a piece's subtree with the given number of
+// leaves from its data, which covers only the file bytes of the piece.
+func PieceRoot(data []byte, leaves int) Hash {
+	return Root(BlockHashes(data), leaves, Hash{})
+}
+
+// Proof returns the uncle hashes needed to verify length nodes starting at
+// index in the base layer, for at most proofLayers layers above the subtree
+// they form. layers must come from Layers.
+func Proof(layers [][]Hash, index, length, proofLayers int) []Hash {
+	var proof []Hash
+	level := len(layers) - 1 - Log2(length)
+	pos := index / length
+	for ; level > 0 && len(proof) < proofLayers; level-- {
+		proof = append(proof, layers[level][pos^1])
+		pos /= 2
+	}
+	return proof
+}
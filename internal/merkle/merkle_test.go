@@ -0,0 +1,159 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHash(t *testing.T, s string) Hash {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		t.Fatalf("bad test hash %q", s)
+	}
+	return Hash(b)
+}
+
+// testData is three full blocks of 1s, 2s and 3s and a short block of 4s
+func testData() []byte {
+	var data []byte
+	for i := byte(1); i <= 3; i++ {
+		data = append(data, bytes.Repeat([]byte{i}, BlockSize)...)
+	}
+	return append(data, bytes.Repeat([]byte{4}, 100)...)
+}
+
+func TestNextPow2(t *testing.T) {
+	tests := []struct{ n, want int }{
+		{-1, 1}, {0, 1}, {1, 1}, {2, 2}, {3, 4}, {4, 4}, {5, 8}, {1023, 1024}, {1024, 1024}, {1025, 2048},
+	}
+	for _, tt := range tests {
+		if got := NextPow2(tt.n); got != tt.want {
+			t.Errorf("NextPow2(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+	for _, n := range []int{1, 2, 16, 1 << 20} {
+		if got := 1 << Log2(n); got != n {
+			t.Errorf("1 << Log2(%d) = %d", n, got)
+		}
+	}
+}
+
+func TestPadHash(t *testing.T) {
+	tests := []struct {
+		leaves int
+		want   string
+	}{
+		{1, "0000000000000000000000000000000000000000000000000000000000000000"},
+		{2, "f5a5fd42d16a20302798ef6ed309979b43003d2320d9f0e8ea9831a92759fb4b"},
+		{4, "db56114e00fdd4c1f85c892bf35ac9a89289aaecb1ebd0a96cde606a748b5d71"},
+	}
+	for _, tt := range tests {
+		if got := PadHash(tt.leaves); got != mustHash(t, tt.want) {
+			t.Errorf("PadHash(%d) = %x, want %s", tt.leaves, got, tt.want)
+		}
+	}
+}
+
+func TestBlockHashes(t *testing.T) {
+	data := testData()
+	leaves := BlockHashes(data)
+	if len(leaves) != 4 {
+		t.Fatalf("got %d leaves, want 4", len(leaves))
+	}
+	if leaves[3] != sha256.Sum256(data[3*BlockSize:]) {
+		t.Error("the short last block is not hashed as is")
+	}
+	if got := BlockHashes(nil); len(got) != 0 {
+		t.Errorf("empty data has %d leaves", len(got))
+	}
+}
+
+func TestRoot(t *testing.T) {
+	data := testData()
+	tests := []struct {
+		name  string
+		data  []byte
+		width int
+		want  string
+	}{
+		{"one zero block", make([]byte, BlockSize), 1, "4fe7b59af6de3b665b67788cc2f99892ab827efae3a467342b3bb4e3bc8e5bfe"},
+		{"four leaves", data, 4, "dd444e22cdb77e11369bda2fb6a16bb2ffaf95ddea02d9d2737c73a6547cce6e"},
+		{"three leaves padded", data[:3*BlockSize], 4, "35754ee03360cacab5e9e27647da3d2a4ab6f97614ed7d1692b9eb3c42a65d69"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PieceRoot(tt.data, tt.width); got != mustHash(t, tt.want) {
+				t.Errorf("root = %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLayers(t *testing.T) {
+	leaves := BlockHashes(testData()[:3*BlockSize])
+	layers := Layers(leaves, 4, Hash{})
+	if len(layers) != 3 || len(layers[0]) != 1 || len(layers[1]) != 2 || len(layers[2]) != 4 {
+		t.Fatalf("layer sizes wrong: %d layers", len(layers))
+	}
+	if layers[2][3] != (Hash{}) {
+		t.Error("base layer is not padded")
+	}
+	if layers[0][0] != Root(leaves, 4, Hash{}) {
+		t.Error("top layer is not the root")
+	}
+}
+
+// verify recomputes the root from the subtree at index of the given
+// length and its proof
+func verify(layers [][]Hash, index, length int, proof []Hash) Hash {
+	base := layers[len(layers)-1]
+	node := Root(base[index:index+length], length, Hash{})
+	pos := index / length
+	for _, uncle := range proof {
+		if pos%2 == 0 {
+			node = hashPair(node, uncle)
+		} else {
+			node = hashPair(uncle, node)
+		}
+		pos /= 2
+	}
+	return node
+}
+
+func TestProof(t *testing.T) {
+	leaves := BlockHashes(testData())
+	layers := Layers(leaves, 8, Hash{})
+	root := layers[0][0]
+
+	tests := []struct {
+		name          string
+		index, length int
+		wantLen       int
+	}{
+		{"single leaf", 2, 1, 3},
+		{"last leaf", 7, 1, 3},
+		{"pair", 2, 2, 2},
+		{"half", 4, 4, 1},
+		{"whole tree", 0, 8, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof := Proof(layers, tt.index, tt.length, 10)
+			if len(proof) != tt.wantLen {
+				t.Fatalf("proof has %d hashes, want %d", len(proof), tt.wantLen)
+			}
+			if got := verify(layers, tt.index, tt.length, proof); got != root {
+				t.Errorf("proof leads to %x, want root %x", got, root)
+			}
+		})
+	}
+
+	// The proof for leaf 2 starts with leaf 3, then the hash of leaves 0 and 1
+	proof := Proof(layers, 2, 1, 2)
+	if len(proof) != 2 || proof[0] != leaves[3] || proof[1] != hashPair(leaves[0], leaves[1]) {
+		t.Errorf("limited proof = %x", proof)
+	}
+}
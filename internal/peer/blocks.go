@@ -0,0 +1,93 @@
+package peer
+
+import "sync"
+
+// blockKey identifies a requested block
+type blockKey struct {
+	index, begin int
+}
+
+// blockDest is where a requested block goes. claimed is set once the reader
+// loop has started filling dst.
+type blockDest struct {
+	dst     []byte
+	claimed bool
+}
+
+// BlockDests tracks where requested blocks should be read to, so the reader
+// loop can put piece data straight into piece buffers. A destination is
+// filled at most once, and once claimed the reader owns it until the
+// message delivering it has been handled.
+type BlockDests struct {
+	mu    sync.Mutex
+	dests map[blockKey]blockDest
+}
+
+func newBlockDests() *BlockDests {
+	return &BlockDests{dests: make(map[blockKey]blockDest)}
+}
+
+// Register sets dst as the destination of a block. It fails while an
+// earlier copy of the block is still being delivered.
+func (b *BlockDests) Register(index, begin int, dst []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := blockKey{index, begin}
+	if b.dests[key].claimed {
+		return false
+	}
+	b.dests[key] = blockDest{dst: dst}
+	return true
+}
+
+// claim hands the destination of a block of the given length to the reader
+func (b *BlockDests) claim(index, begin, length int) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := blockKey{index, begin}
+	d, ok := b.dests[key]
+	if !ok || d.claimed || len(d.dst) != length {
+		return nil
+	}
+	d.claimed = true
+	b.dests[key] = d
+	return d.dst
+}
+
+// Delivered releases the destination of a block read in place, once its
+// message has been handled
+func (b *BlockDests) Delivered(index, begin int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.dests, blockKey{index, begin})
+}
+
+// Take removes an unclaimed destination, so a copy of the block received
+// another way can be used instead. It reports false when the reader is
+// filling the destination, in which case that copy should be awaited.
+func (b *BlockDests) Take(index, begin int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := blockKey{index, begin}
+	if b.dests[key].claimed {
+		return false
+	}
+	delete(b.dests, key)
+	return true
+}
+
+// DropUnclaimed forgets destinations the reader has not started on, such
+// as after the peer chokes us
+func (b *BlockDests) DropUnclaimed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, d := range b.dests {
+		if !d.claimed {
+			delete(b.dests, key)
+		}
+	}
+}
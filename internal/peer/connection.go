@@ -2,10 +2,16 @@ package peer
 
 import (
 	"btc/internal/config"
+	"btc/internal/logger"
 	"btc/internal/protocol"
+	"btc/internal/proxy"
+	"btc/internal/version"
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -17,9 +23,37 @@ type Client struct {
 	peerID   [20]byte
 	Choke    bool
 	cfg      *config.Config
+	// RemoteID is the peer's ID and Info the client it runs, refined by
+	// the extension handshake when the peer sends one
+	RemoteID [20]byte
+	Info     ClientInfo
+	// Reqq is how many requests the peer queues, zero when not advertised
+	Reqq int
+	// Extensions maps BEP 10 extension names to the peer's message IDs
+	Extensions map[string]int
+	// limits validates incoming messages, nil accepts any well framed message
+	limits *protocol.Limits
+	// Blocks holds the destinations of requested blocks, which the reader
+	// loop fills directly
+	Blocks *BlockDests
+	reader *protocol.Reader
+
+	incoming  chan *protocol.Message
+	outgoing  chan *protocol.Message
+	done      chan struct{}
+	closeOnce sync.Once
+	errMu     sync.Mutex
+	err       error
 }
 
-func CompleteHandshake(conn net.Conn, infohash, peerID [20]byte, cfg *config.Config) (*protocol.Handshake, error) {
+// Queue sizes of the reader and writer loops
+const (
+	incomingQueue = 64
+	outgoingQueue = 256
+	writeBufSize  = 32 * 1024
+)
+
+func CompleteHandshake(conn net.Conn, infohash, peerID [20]byte, reserved [8]byte, cfg *config.Config) (*protocol.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(cfg.HandshakeTimeout))
 	defer conn.SetDeadline(time.Time{})
 
@@ -27,6 +61,7 @@ func CompleteHandshake(conn net.Conn, infohash, peerID [20]byte, cfg *config.Con
 	if err != nil {
 		return nil, err
 	}
+	req.Reserved = reserved
 	_, err = conn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -44,87 +79,293 @@ func CompleteHandshake(conn net.Conn, infohash, peerID [20]byte, cfg *config.Con
 	return res, nil
 }
 
-func ReceiveBitfield(conn net.Conn, cfg *config.Config) (protocol.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(cfg.HandshakeTimeout))
-	defer conn.SetDeadline(time.Time{})
+// ReceiveBitfield reads the peer's bitfield, which must be its first message
+// apart from BEP 10 messages, which are passed to the client
+func (c *Client) ReceiveBitfield() error {
+	c.Conn.SetReadDeadline(time.Now().Add(c.cfg.HandshakeTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
 
-	msg, err := protocol.Read(conn)
-	if err != nil {
-		return nil, err
-	}
+	for {
+		msg, err := c.reader.ReadMessage()
+		if err != nil {
+			return err
+		}
 
-	if msg == nil {
-		return nil, fmt.Errorf("got nil message instead of bitfield")
-	}
-	if msg.ID != protocol.MsgBitfield {
-		return nil, fmt.Errorf("expected bitfield but got ID %d", msg.ID)
-	}
+		if msg == nil {
+			return fmt.Errorf("got nil message instead of bitfield")
+		}
+		if msg.ID == protocol.MsgExtended {
+			// An odd extension message is no reason to drop the peer
+			if err := c.HandleExtended(msg); err != nil {
+				logger.Debug("bad extended message", "peer", c.Peer.String(), "error", err)
+			}
+			msg.Release()
+			continue
+		}
+		if msg.ID != protocol.MsgBitfield {
+			return fmt.Errorf("expected bitfield but got ID %d", msg.ID)
+		}
+		if c.limits != nil {
+			if err := c.limits.ValidateBitfield(msg.Payload); err != nil {
+				return err
+			}
+		}
 
-	return msg.Payload, nil
+		c.Bitfield = msg.Payload
+		return nil
+	}
 }
 
-// New creates a new peer client connection
-func New(peer Peer, peerID, infohash [20]byte, cfg *config.Config) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), cfg.TCPTimeout)
+// New creates a new peer client connection. reserved holds the handshake
+// extension bits to advertise and limits describes the torrent, to reject
+// messages that violate the protocol.
+func New(peer Peer, peerID, infohash [20]byte, reserved [8]byte, limits *protocol.Limits, cfg *config.Config) (*Client, error) {
+	conn, err := proxy.Dial(cfg, proxy.Peers, peer.String(), cfg.TCPTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = CompleteHandshake(conn, infohash, peerID, cfg)
+	res, err := CompleteHandshake(conn, infohash, peerID, reserved, cfg)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	return newClient(conn, peer, res, peerID, reserved, limits, cfg)
+}
 
-	bfield, err := ReceiveBitfield(conn, cfg)
+// Accept answers the handshake hs of a peer that connected to us and
+// returns a client for the connection, like New does for outgoing ones
+func Accept(conn net.Conn, peer Peer, hs *protocol.Handshake, peerID [20]byte, reserved [8]byte, limits *protocol.Limits, cfg *config.Config) (*Client, error) {
+	ours, err := protocol.NewHandshake(hs.InfoHash, peerID)
 	if err != nil {
+		return nil, err
+	}
+	ours.Reserved = reserved
+	conn.SetWriteDeadline(time.Now().Add(cfg.HandshakeTimeout))
+	if _, err := conn.Write(ours.Serialize()); err != nil {
 		conn.Close()
 		return nil, err
 	}
+	conn.SetWriteDeadline(time.Time{})
+	return newClient(conn, peer, hs, peerID, reserved, limits, cfg)
+}
 
-	return &Client{
+// newClient starts the reader and writer loops of a connection whose
+// handshake res is complete, and waits for the peer's bitfield
+func newClient(conn net.Conn, peer Peer, res *protocol.Handshake, peerID [20]byte, reserved [8]byte, limits *protocol.Limits, cfg *config.Config) (*Client, error) {
+	c := &Client{
 		Conn:     conn,
-		Bitfield: bfield,
 		Peer:     peer,
-		infohash: infohash,
+		infohash: res.InfoHash,
 		peerID:   peerID,
 		Choke:    true,
 		cfg:      cfg,
-	}, nil
+		RemoteID: res.PeerID,
+		Info:     ParseClient(res.PeerID),
+		limits:   limits,
+		Blocks:   newBlockDests(),
+		incoming: make(chan *protocol.Message, incomingQueue),
+		outgoing: make(chan *protocol.Message, outgoingQueue),
+		done:     make(chan struct{}),
+	}
+	c.reader = protocol.NewReader(conn)
+	c.reader.BlockDest = c.Blocks.claim
+	go c.writeLoop()
+	ours := protocol.Handshake{Reserved: reserved}
+	if ours.SupportsExtended() && res.SupportsExtended() {
+		if err := c.sendExtendedHandshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if err := c.ReceiveBitfield(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Client) sendExtendedHandshake() error {
+	msg, err := protocol.FormatExtendedHandshake(&protocol.ExtendedHandshake{
+		V:    version.String(),
+		Port: int(c.cfg.ListenPort),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Send(msg)
+}
+
+// HandleExtended processes a BEP 10 message. Only the extension handshake
+// is understood, other extensions are ignored.
+func (c *Client) HandleExtended(msg *protocol.Message) error {
+	id, body, err := protocol.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	if id != protocol.ExtHandshakeID {
+		return nil
+	}
+	hs, err := protocol.ParseExtendedHandshake(body)
+	if err != nil {
+		return err
+	}
+	if hs.V != "" {
+		c.Info = ParseClientVersion(hs.V)
+	}
+	if hs.Reqq > 0 {
+		c.Reqq = hs.Reqq
+	}
+	c.Extensions = hs.M
+	return nil
+}
+
+// readLoop decodes and validates messages from the connection into the
+// incoming channel, which is closed when the connection fails, a message
+// violates the protocol or the peer stays silent for PeerReadTimeout
+func (c *Client) readLoop() {
+	defer close(c.incoming)
+	for {
+		if c.cfg.PeerReadTimeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.cfg.PeerReadTimeout))
+		}
+		msg, err := c.reader.ReadMessage()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = fmt.Errorf("nothing received for %s: %w", c.cfg.PeerReadTimeout, err)
+		}
+		if err == nil && c.limits != nil {
+			if err = c.limits.Validate(msg); err != nil {
+				msg.Release()
+			}
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		select {
+		case c.incoming <- msg:
+		case <-c.done:
+			msg.Release()
+			return
+		}
+	}
+}
+
+// writeLoop writes queued messages, batching whatever is queued into a
+// single vectored write. A keep-alive is sent after KeepAliveInterval
+// without writes.
+func (c *Client) writeLoop() {
+	w := protocol.NewWriter(c.Conn)
+	var keepAlive <-chan time.Time
+	var timer *time.Timer
+	if c.cfg.KeepAliveInterval > 0 {
+		timer = time.NewTimer(c.cfg.KeepAliveInterval)
+		defer timer.Stop()
+		keepAlive = timer.C
+	}
+	for {
+		select {
+		case msg := <-c.outgoing:
+			w.WriteMessage(msg)
+		drain:
+			for w.Buffered() < writeBufSize {
+				select {
+				case msg := <-c.outgoing:
+					w.WriteMessage(msg)
+				default:
+					break drain
+				}
+			}
+		case <-keepAlive:
+			w.WriteMessage(nil)
+		case <-c.done:
+			return
+		}
+		c.Conn.SetWriteDeadline(time.Now().Add(c.cfg.TCPTimeout))
+		if err := w.Flush(); err != nil {
+			c.fail(err)
+			return
+		}
+		if timer != nil {
+			timer.Reset(c.cfg.KeepAliveInterval)
+		}
+	}
+}
+
+// fail records the first error and closes the connection
+func (c *Client) fail(err error) {
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+	c.Close()
+}
+
+// Err returns why the connection stopped, or nil while it is open
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil {
+		select {
+		case <-c.done:
+			return net.ErrClosed
+		default:
+		}
+	}
+	return c.err
+}
+
+// Messages returns the channel of decoded messages, closed once the
+// connection fails. Keep-alives are delivered as nil. Receivers Release
+// each message once handled.
+func (c *Client) Messages() <-chan *protocol.Message {
+	return c.incoming
 }
 
+// Read waits for the next message
 func (c *Client) Read() (*protocol.Message, error) {
-	return protocol.Read(c.Conn)
+	msg, ok := <-c.incoming
+	if !ok {
+		return nil, c.Err()
+	}
+	return msg, nil
+}
+
+// Send queues a message for the writer loop
+func (c *Client) Send(msg *protocol.Message) error {
+	select {
+	case c.outgoing <- msg:
+		return nil
+	case <-c.done:
+		return c.Err()
+	}
 }
 
 func (c *Client) SendRequest(index, begin, length int) error {
-	req := protocol.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.Send(protocol.FormatRequest(index, begin, length))
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+	return c.Send(protocol.FormatCancel(index, begin, length))
 }
 
 func (c *Client) SendInterested() error {
-	msg := protocol.Message{ID: protocol.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.Send(&protocol.Message{ID: protocol.MsgInterested})
 }
 
 func (c *Client) SendNotInterested() error {
-	msg := protocol.Message{ID: protocol.MsgUnInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.Send(&protocol.Message{ID: protocol.MsgUnInterested})
 }
 
 func (c *Client) SendUnchoke() error {
-	msg := protocol.Message{ID: protocol.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.Send(&protocol.Message{ID: protocol.MsgUnchoke})
 }
 
 func (c *Client) SendHave(index int) error {
-	msg := protocol.FormatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.Send(protocol.FormatHave(index))
 }
 
 func (c *Client) GetBitfield() protocol.Bitfield {
@@ -135,6 +376,12 @@ func (c *Client) IsChoked() bool {
 	return c.Choke
 }
 
+// Close stops the reader and writer loops and closes the connection
 func (c *Client) Close() error {
-	return c.Conn.Close()
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
 }
@@ -8,6 +8,9 @@ type Connection interface {
 	// Read reads and parses the next message from the peer
 	Read() (*protocol.Message, error)
 
+	// Send writes an arbitrary message to the peer
+	Send(msg *protocol.Message) error
+
 	// SendRequest sends request for a block from the peer
 	SendRequest(index, begin, length int) error
 
@@ -0,0 +1,161 @@
+package peer
+
+import (
+	"btc/internal/version"
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// peerIDChars are used for the random part of our peer ID, so it stays
+// readable in tracker logs
+const peerIDChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// GeneratePeerID returns an Azureus style peer ID: the version prefix
+// followed by random characters
+func GeneratePeerID() ([20]byte, error) {
+	var id [20]byte
+	prefix := version.PeerIDPrefix()
+	n := copy(id[:], prefix)
+	if _, err := rand.Read(id[n:]); err != nil {
+		return id, fmt.Errorf("generating peer ID: %w", err)
+	}
+	for i := n; i < len(id); i++ {
+		id[i] = peerIDChars[int(id[i])%len(peerIDChars)]
+	}
+	return id, nil
+}
+
+// ClientInfo names the software a peer runs
+type ClientInfo struct {
+	Name    string
+	Version string
+}
+
+func (c ClientInfo) String() string {
+	switch {
+	case c.Name == "":
+		return "unknown"
+	case c.Version == "":
+		return c.Name
+	default:
+		return c.Name + " " + c.Version
+	}
+}
+
+// azureusClients maps Azureus style client codes to names
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FG": "FlashGet",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+
+	version.ClientCode: version.Name,
+}
+
+// shadowClients maps Shadow style client letters to names
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaculture",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigits are the version characters of Shadow style IDs, by value
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+var mainlineID = regexp.MustCompile(`^M(\d+)-(\d+)-(\d+)-`)
+
+// ParseClient identifies the client from a peer ID in Azureus
+// (-AZ2060-), Shadow (S58B-----) or Mainline (M4-3-6--) style.
+// Unrecognised IDs give an empty ClientInfo.
+func ParseClient(id [20]byte) ClientInfo {
+	s := string(id[:])
+	switch {
+	case s[0] == '-' && s[7] == '-':
+		code := s[1:3]
+		name, ok := azureusClients[code]
+		if !ok {
+			name = code
+		}
+		return ClientInfo{Name: name, Version: azureusVersion(s[3:7])}
+	case mainlineID.MatchString(s):
+		m := mainlineID.FindStringSubmatch(s)
+		return ClientInfo{Name: "Mainline", Version: m[1] + "." + m[2] + "." + m[3]}
+	}
+	if name, ok := shadowClients[s[0]]; ok {
+		if v, ok := shadowVersion(s[1:]); ok {
+			return ClientInfo{Name: name, Version: v}
+		}
+	}
+	return ClientInfo{}
+}
+
+// azureusVersion renders four version characters as a dotted version,
+// dropping a trailing zero fourth part
+func azureusVersion(digits string) string {
+	parts := make([]string, 0, len(digits))
+	for _, c := range []byte(digits) {
+		n, err := strconv.ParseInt(string(c), 36, 64)
+		if err != nil {
+			return digits
+		}
+		parts = append(parts, strconv.Itoa(int(n)))
+	}
+	for len(parts) > 3 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+// shadowVersion decodes the version characters that follow the client
+// letter, ended by "---"
+func shadowVersion(s string) (string, bool) {
+	end := strings.Index(s, "---")
+	if end < 1 || end > 5 {
+		return "", false
+	}
+	parts := make([]string, 0, end)
+	for _, c := range []byte(s[:end]) {
+		n := strings.IndexByte(shadowDigits, c)
+		if n < 0 || c == '-' {
+			return "", false
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, "."), true
+}
+
+// ParseClientVersion splits a BEP 10 "v" string like "qBittorrent/4.6.3"
+// or "Transmission 4.0.5" into name and version
+func ParseClientVersion(v string) ClientInfo {
+	v = strings.TrimSpace(v)
+	if i := strings.LastIndexAny(v, " /"); i > 0 && i < len(v)-1 {
+		if ver := v[i+1:]; ver[0] >= '0' && ver[0] <= '9' || ver[0] == 'v' {
+			return ClientInfo{Name: v[:i], Version: strings.TrimPrefix(ver, "v")}
+		}
+	}
+	return ClientInfo{Name: v}
+}
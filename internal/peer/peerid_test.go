@@ -0,0 +1,73 @@
+package peer
+
+import (
+	"btc/internal/version"
+	"strings"
+	"testing"
+)
+
+func id(s string) [20]byte {
+	var b [20]byte
+	copy(b[:], s)
+	return b
+}
+
+func TestParseClient(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want ClientInfo
+	}{
+		{"azureus", "-qB4630-abcdefghijkl", ClientInfo{"qBittorrent", "4.6.3"}},
+		{"azureus four parts", "-TR4051-abcdefghijkl", ClientInfo{"Transmission", "4.0.5.1"}},
+		{"azureus letter digits", "-UT355A-abcdefghijkl", ClientInfo{"µTorrent", "3.5.5.10"}},
+		{"azureus case sensitive code", "-lt0D60-abcdefghijkl", ClientInfo{"rTorrent", "0.13.6"}},
+		{"azureus unknown code", "-ZZ1000-abcdefghijkl", ClientInfo{"ZZ", "1.0.0"}},
+		{"azureus bad version", "-AZ2.6!-abcdefghijkl", ClientInfo{"Vuze", "2.6!"}},
+		{"shadow", "S58B-----abcdefghijk", ClientInfo{"Shadow", "5.8.11"}},
+		{"shadow bittornado", "T03I-----abcdefghijk", ClientInfo{"BitTornado", "0.3.18"}},
+		{"shadow without terminator", "S58Babcdefghijklmnop", ClientInfo{}},
+		{"shadow version too long", "T123456---abcdefghij", ClientInfo{}},
+		{"mainline", "M4-3-6--abcdefghijkl", ClientInfo{"Mainline", "4.3.6"}},
+		{"mainline two digit part", "M7-10-2-abcdefghijkl", ClientInfo{"Mainline", "7.10.2"}},
+		{"zero bytes", "", ClientInfo{}},
+		{"garbage", "\xff\x00\x13garbage!!!!!!!!!!!", ClientInfo{}},
+		{"dash without code", "-abcdefghijklmnopqrs", ClientInfo{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseClient(id(tt.id)); got != tt.want {
+				t.Errorf("ParseClient(%q) = %+v, want %+v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOwnPeerID(t *testing.T) {
+	peerID, err := GeneratePeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(peerID[:]), version.PeerIDPrefix()) {
+		t.Fatalf("peer ID %q lacks prefix %q", peerID, version.PeerIDPrefix())
+	}
+	if got := ParseClient(peerID); got.Name != version.Name {
+		t.Errorf("own peer ID parsed as %+v, want %s", got, version.Name)
+	}
+}
+
+func TestClientInfoString(t *testing.T) {
+	tests := []struct {
+		info ClientInfo
+		want string
+	}{
+		{ClientInfo{}, "unknown"},
+		{ClientInfo{Name: "ZZ"}, "ZZ"},
+		{ClientInfo{"qBittorrent", "4.6.3"}, "qBittorrent 4.6.3"},
+	}
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.info, got, tt.want)
+		}
+	}
+}
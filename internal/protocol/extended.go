@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"btc/internal/bencode"
+	"fmt"
+)
+
+// MsgExtended carries BEP 10 extension messages
+const MsgExtended MessageID = 20
+
+// ExtHandshakeID is the extended message ID of the extension handshake
+const ExtHandshakeID = 0
+
+const (
+	reservedExtByte = 5
+	reservedExtMask = 0x10 // BEP 10 extension protocol
+)
+
+// SetExtended advertises support for the extension protocol
+func (h *Handshake) SetExtended() {
+	h.Reserved[reservedExtByte] |= reservedExtMask
+}
+
+// SupportsExtended reports whether the peer supports the extension protocol
+func (h *Handshake) SupportsExtended() bool {
+	return h.Reserved[reservedExtByte]&reservedExtMask != 0
+}
+
+// ExtendedHandshake is the payload of the BEP 10 handshake
+type ExtendedHandshake struct {
+	// M maps extension names to the message IDs the sender wants them on
+	M    map[string]int `bencode:"m"`
+	V    string         `bencode:"v,omitempty"`    // client name and version
+	Reqq int            `bencode:"reqq,omitempty"` // outstanding requests the sender queues
+	Port int            `bencode:"p,omitempty"`
+}
+
+// FormatExtendedHandshake builds the extension handshake message
+func FormatExtendedHandshake(hs *ExtendedHandshake) (*Message, error) {
+	if hs.M == nil {
+		hs.M = map[string]int{}
+	}
+	data, err := bencode.Marshal(hs)
+	if err != nil {
+		return nil, fmt.Errorf("encoding extended handshake: %w", err)
+	}
+	payload := append([]byte{ExtHandshakeID}, data...)
+	return &Message{ID: MsgExtended, Payload: payload}, nil
+}
+
+// ParseExtended splits an extended message into its extension ID and body
+func ParseExtended(msg *Message) (byte, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected extended message, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("empty extended message")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// ParseExtendedHandshake decodes the body of an extension handshake
+func ParseExtendedHandshake(body []byte) (*ExtendedHandshake, error) {
+	var hs ExtendedHandshake
+	if err := bencode.Unmarshal(body, &hs); err != nil {
+		return nil, fmt.Errorf("parsing extended handshake: %w", err)
+	}
+	return &hs, nil
+}
@@ -0,0 +1,182 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// readBufSize is the read buffer of a Reader
+const readBufSize = 32 * 1024
+
+// BlockDestFunc returns where the block of a piece message should be read
+// to, or nil to read it into a pooled payload like any other message
+type BlockDestFunc func(index, begin, length int) []byte
+
+// Reader reads messages into pooled buffers. Callers hand each message back
+// with Release once done with it.
+type Reader struct {
+	r      *bufio.Reader
+	header [8]byte
+	// BlockDest, when set, lets piece data skip the payload buffer
+	BlockDest BlockDestFunc
+}
+
+// NewReader returns a Reader for a connection
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, readBufSize)}
+}
+
+// ReadMessage reads the next message. Keep-alives are returned as nil.
+func (r *Reader) ReadMessage() (*Message, error) {
+	if _, err := io.ReadFull(r.r, r.header[:4]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(r.header[:4])
+	if length == 0 {
+		return nil, nil
+	}
+	if length > MaxMessageLength {
+		return nil, &ProtocolError{Reason: fmt.Sprintf("message length %d exceeds %d", length, MaxMessageLength)}
+	}
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	id := MessageID(b)
+	n := int(length) - 1
+
+	if id == MsgPiece && n > 8 && r.BlockDest != nil {
+		if _, err := io.ReadFull(r.r, r.header[:8]); err != nil {
+			return nil, err
+		}
+		index := int(binary.BigEndian.Uint32(r.header[0:4]))
+		begin := int(binary.BigEndian.Uint32(r.header[4:8]))
+		if dst := r.BlockDest(index, begin, n-8); dst != nil {
+			msg := newPooledMessage(id, 8)
+			copy(msg.Payload, r.header[:8])
+			if _, err := io.ReadFull(r.r, dst); err != nil {
+				msg.Release()
+				return nil, err
+			}
+			msg.Block = dst
+			return msg, nil
+		}
+		msg := newPooledMessage(id, n)
+		copy(msg.Payload, r.header[:8])
+		if _, err := io.ReadFull(r.r, msg.Payload[8:]); err != nil {
+			msg.Release()
+			return nil, err
+		}
+		return msg, nil
+	}
+
+	msg := newPooledMessage(id, n)
+	if _, err := io.ReadFull(r.r, msg.Payload); err != nil {
+		msg.Release()
+		return nil, err
+	}
+	return msg, nil
+}
+
+// vectoredMin is the payload size from which a Writer passes payloads to
+// the connection as they are instead of copying them
+const vectoredMin = 1024
+
+// Writer frames messages without allocating. Headers and small payloads
+// are copied into a reused buffer, large payloads such as bitfields and
+// blocks are sent from where they are with a vectored write.
+type Writer struct {
+	w    io.Writer
+	buf  []byte
+	segs []segment
+	vecs net.Buffers
+	out  net.Buffers
+	size int
+}
+
+// segment is a run of buf, or an external slice when ext is set
+type segment struct {
+	start, end int
+	ext        []byte
+}
+
+// NewWriter returns a Writer for a connection
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteMessage queues a message for the next Flush. A nil message is a
+// keep-alive. The payload must not change until then.
+func (w *Writer) WriteMessage(msg *Message) {
+	if msg == nil {
+		start := len(w.buf)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, 0)
+		w.extend(start)
+		return
+	}
+	w.appendHeader(uint32(1+len(msg.Payload)+len(msg.Block)), msg.ID)
+	w.appendPayload(msg.Payload)
+	w.appendPayload(msg.Block)
+}
+
+// appendHeader adds the length prefix and ID of a message
+func (w *Writer) appendHeader(length uint32, id MessageID) {
+	start := len(w.buf)
+	w.buf = binary.BigEndian.AppendUint32(w.buf, length)
+	w.buf = append(w.buf, byte(id))
+	w.extend(start)
+}
+
+func (w *Writer) appendPayload(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if len(p) < vectoredMin {
+		start := len(w.buf)
+		w.buf = append(w.buf, p...)
+		w.extend(start)
+		return
+	}
+	w.segs = append(w.segs, segment{ext: p})
+	w.size += len(p)
+}
+
+// extend adds buf[start:] to the last segment, or starts a new one
+func (w *Writer) extend(start int) {
+	w.size += len(w.buf) - start
+	if n := len(w.segs); n > 0 && w.segs[n-1].ext == nil {
+		w.segs[n-1].end = len(w.buf)
+		return
+	}
+	w.segs = append(w.segs, segment{start: start, end: len(w.buf)})
+}
+
+// Buffered returns the number of bytes waiting for Flush
+func (w *Writer) Buffered() int {
+	return w.size
+}
+
+// Flush writes everything queued in one vectored write
+func (w *Writer) Flush() error {
+	if w.size == 0 {
+		return nil
+	}
+	w.vecs = w.vecs[:0]
+	for _, s := range w.segs {
+		if s.ext != nil {
+			w.vecs = append(w.vecs, s.ext)
+		} else {
+			w.vecs = append(w.vecs, w.buf[s.start:s.end])
+		}
+	}
+	w.out = w.vecs
+	_, err := w.out.WriteTo(w.w)
+	clear(w.segs)
+	w.segs = w.segs[:0]
+	w.buf = w.buf[:0]
+	w.size = 0
+	return err
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+const benchBlockSize = 16 * 1024
+
+// repeatReader serves the same bytes over and over
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// pieceMessage frames a piece message carrying one block
+func pieceMessage(index, begin int, block []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(9+len(block)))
+	b = append(b, byte(MsgPiece))
+	b = binary.BigEndian.AppendUint32(b, uint32(index))
+	b = binary.BigEndian.AppendUint32(b, uint32(begin))
+	return append(b, block...)
+}
+
+func TestFramingRoundTrip(t *testing.T) {
+	block := make([]byte, benchBlockSize)
+	for i := range block {
+		block[i] = byte(i * 7)
+	}
+	var conn bytes.Buffer
+	w := NewWriter(&conn)
+	w.WriteMessage(FormatHave(5))
+	w.WriteMessage(nil)
+	w.WriteMessage(&Message{ID: MsgPiece, Payload: pieceMessage(2, benchBlockSize, nil)[5:], Block: block})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := make([]byte, benchBlockSize)
+	r := NewReader(&conn)
+	r.BlockDest = func(index, begin, length int) []byte {
+		if index != 2 || begin != benchBlockSize || length != benchBlockSize {
+			t.Errorf("BlockDest(%d, %d, %d)", index, begin, length)
+			return nil
+		}
+		return dst
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil || msg.ID != MsgHave || binary.BigEndian.Uint32(msg.Payload) != 5 {
+		t.Fatalf("have: %v, %v", msg, err)
+	}
+	msg.Release()
+	if msg, err := r.ReadMessage(); msg != nil || err != nil {
+		t.Fatalf("keep-alive: %v, %v", msg, err)
+	}
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.BlockData(), block) || !bytes.Equal(dst, block) {
+		t.Error("block not read in place")
+	}
+	msg.Release()
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("after last message: %v", err)
+	}
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	block := make([]byte, benchBlockSize)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	dst := make([]byte, benchBlockSize)
+	r := NewReader(&repeatReader{data: pieceMessage(3, 0, block)})
+	r.BlockDest = func(index, begin, length int) []byte {
+		return dst[:length]
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(benchBlockSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(msg.Block) != benchBlockSize {
+			b.Fatalf("block read to payload, got %d block bytes", len(msg.Block))
+		}
+		msg.Release()
+	}
+}
+
+func BenchmarkReadMessagePooled(b *testing.B) {
+	r := NewReader(&repeatReader{data: pieceMessage(3, 0, make([]byte, benchBlockSize))})
+
+	b.ReportAllocs()
+	b.SetBytes(benchBlockSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg.Release()
+	}
+}
+
+func BenchmarkWritePiece(b *testing.B) {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload[0:4], 3)
+	msg := &Message{ID: MsgPiece, Payload: payload, Block: make([]byte, benchBlockSize)}
+	w := NewWriter(io.Discard)
+
+	b.ReportAllocs()
+	b.SetBytes(benchBlockSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.WriteMessage(msg)
+		if err := w.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
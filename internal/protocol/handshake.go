@@ -5,8 +5,15 @@ import (
 	"io"
 )
 
+// Reserved handshake bits, as byte index and mask
+const (
+	reservedV2Byte = 7
+	reservedV2Mask = 0x10 // BEP 52 BitTorrent v2 support
+)
+
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -19,13 +26,23 @@ func NewHandshake(infohash [20]byte, peerID [20]byte) (*Handshake, error) {
 	}, nil
 }
 
+// SetV2 advertises BitTorrent v2 support
+func (h *Handshake) SetV2() {
+	h.Reserved[reservedV2Byte] |= reservedV2Mask
+}
+
+// SupportsV2 reports whether the peer advertised BitTorrent v2 support
+func (h *Handshake) SupportsV2() bool {
+	return h.Reserved[reservedV2Byte]&reservedV2Mask != 0
+}
+
 func (h *Handshake) Serialize() []byte {
 	buffer := make([]byte, len(h.Pstr)+49)
 	buffer[0] = byte(len(h.Pstr))
 
 	point := 1
 	point += copy(buffer[point:], h.Pstr)
-	point += copy(buffer[point:], make([]byte, 8))
+	point += copy(buffer[point:], h.Reserved[:])
 	point += copy(buffer[point:], h.InfoHash[:])
 	point += copy(buffer[point:], h.PeerID[:])
 
@@ -53,12 +70,15 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 	}
 
 	var peerID, infohash [20]byte
+	var reserved [8]byte
 
+	copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	copy(infohash[:], handshakeBuf[pstrLen+8:pstrLen+28])
 	copy(peerID[:], handshakeBuf[pstrLen+28:])
 
 	return &Handshake{
 		Pstr:     string(handshakeBuf[:pstrLen]),
+		Reserved: reserved,
 		PeerID:   peerID,
 		InfoHash: infohash,
 	}, nil
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// HashRequest identifies a range of merkle hashes of a file (BEP 52). It is
+// the payload of hash request and hash reject, and the header of hashes.
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+const hashRequestLen = 32 + 4*4
+
+func (r *HashRequest) serialize(extra int) []byte {
+	payload := make([]byte, hashRequestLen, hashRequestLen+extra)
+	copy(payload[0:32], r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
+// FormatHashRequest builds a hash request message
+func FormatHashRequest(r *HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: r.serialize(0)}
+}
+
+// FormatHashReject builds a hash reject message echoing a request
+func FormatHashReject(r *HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: r.serialize(0)}
+}
+
+// FormatHashes builds a hashes message answering r
+func FormatHashes(r *HashRequest, hashes [][32]byte) *Message {
+	payload := r.serialize(32 * len(hashes))
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// ParseHashRequest parses a hash request or hash reject message
+func ParseHashRequest(msg *Message) (*HashRequest, error) {
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashReject {
+		return nil, fmt.Errorf("message ID %d is not a hash request or reject", msg.ID)
+	}
+	if len(msg.Payload) != hashRequestLen {
+		return nil, fmt.Errorf("hash request payload length %d, expected %d", len(msg.Payload), hashRequestLen)
+	}
+	return parseHashRequest(msg.Payload), nil
+}
+
+// ParseHashes parses a hashes message into its request header and hashes
+func ParseHashes(msg *Message) (*HashRequest, [][32]byte, error) {
+	if msg.ID != MsgHashes {
+		return nil, nil, fmt.Errorf("message ID %d is not hashes", msg.ID)
+	}
+	if len(msg.Payload) < hashRequestLen || (len(msg.Payload)-hashRequestLen)%32 != 0 {
+		return nil, nil, fmt.Errorf("malformed hashes payload length %d", len(msg.Payload))
+	}
+
+	req := parseHashRequest(msg.Payload)
+	rest := msg.Payload[hashRequestLen:]
+	hashes := make([][32]byte, len(rest)/32)
+	for i := range hashes {
+		copy(hashes[i][:], rest[i*32:])
+	}
+	return req, hashes, nil
+}
+
+func parseHashRequest(payload []byte) *HashRequest {
+	r := &HashRequest{
+		BaseLayer:   int(binary.BigEndian.Uint32(payload[32:36])),
+		Index:       int(binary.BigEndian.Uint32(payload[36:40])),
+		Length:      int(binary.BigEndian.Uint32(payload[40:44])),
+		ProofLayers: int(binary.BigEndian.Uint32(payload[44:48])),
+	}
+	copy(r.PiecesRoot[:], payload[0:32])
+	return r
+}
@@ -18,11 +18,20 @@ const (
 	MsgRequest      MessageID = 6
 	MsgPiece        MessageID = 7
 	MsgCancel       MessageID = 8
+	MsgHashRequest  MessageID = 21
+	MsgHashes       MessageID = 22
+	MsgHashReject   MessageID = 23
 )
 
 type Message struct {
 	Payload []byte
 	ID      MessageID
+	// Block is the data of a piece message read straight into its
+	// destination, in which case Payload only holds index and begin
+	Block []byte
+
+	buf    *[]byte // pooled backing array of Payload
+	pooled bool
 }
 
 func FormatRequest(index, begin, length int) *Message {
@@ -33,6 +42,13 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+// FormatCancel withdraws an earlier request
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload[:], uint32(index))
@@ -58,15 +74,26 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 		return 0, fmt.Errorf("begin offset too high: %d >= %d", begin, len(buf))
 	}
 
-	data := msg.Payload[8:]
+	data := msg.BlockData()
 	if begin+len(data) > len(buf) {
 		return 0, fmt.Errorf("data too long for offset: data=%d, offset=%d, bufLen=%d", len(data), begin, len(buf))
 	}
 
-	copy(buf[begin:], data)
+	// Blocks read in place need no copy
+	if len(data) > 0 && &buf[begin] != &data[0] {
+		copy(buf[begin:], data)
+	}
 	return len(data), nil
 }
 
+// BlockData returns the block carried by a piece message
+func (msg *Message) BlockData() []byte {
+	if msg.Block != nil {
+		return msg.Block
+	}
+	return msg.Payload[8:]
+}
+
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
 		return 0, fmt.Errorf("message ID does not match MsgHave")
@@ -93,6 +120,9 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > MaxMessageLength {
+		return nil, &ProtocolError{Reason: fmt.Sprintf("message length %d exceeds %d", length, MaxMessageLength)}
+	}
 
 	msgBuf := make([]byte, length)
 	_, err = io.ReadFull(r, msgBuf)
@@ -145,6 +175,14 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgRequest:
 		return "Request"
+	case MsgExtended:
+		return "Extended"
+	case MsgHashRequest:
+		return "HashRequest"
+	case MsgHashes:
+		return "Hashes"
+	case MsgHashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -154,5 +192,5 @@ func (m *Message) String() string {
 	if m == nil {
 		return m.name()
 	}
-	return fmt.Sprintf("%s [%d]", m.name(), len(m.Payload))
+	return fmt.Sprintf("%s [%d]", m.name(), len(m.Payload)+len(m.Block))
 }
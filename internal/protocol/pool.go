@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Pooled buffers come in power of two size classes, larger payloads are
+// allocated
+const (
+	minPoolShift = 6  // 64 bytes
+	maxPoolShift = 18 // 256 KiB
+)
+
+var (
+	bufferPools [maxPoolShift - minPoolShift + 1]sync.Pool
+	messagePool = sync.Pool{New: func() any { return new(Message) }}
+)
+
+// poolClass returns the size class holding n bytes, or -1 when n is too big
+func poolClass(n int) int {
+	shift := minPoolShift
+	if n > 1 {
+		shift = max(bits.Len(uint(n-1)), minPoolShift)
+	}
+	if shift > maxPoolShift {
+		return -1
+	}
+	return shift - minPoolShift
+}
+
+// getBuffer returns a buffer of length n, from the pool when it fits a class
+func getBuffer(n int) *[]byte {
+	class := poolClass(n)
+	if class < 0 {
+		b := make([]byte, n)
+		return &b
+	}
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		*b = (*b)[:n]
+		return b
+	}
+	b := make([]byte, n, 1<<(class+minPoolShift))
+	return &b
+}
+
+// putBuffer returns a buffer from getBuffer to its pool
+func putBuffer(b *[]byte) {
+	class := poolClass(cap(*b))
+	if class < 0 || cap(*b) != 1<<(class+minPoolShift) {
+		return
+	}
+	bufferPools[class].Put(b)
+}
+
+// newPooledMessage returns a message from the pool with an n byte payload
+func newPooledMessage(id MessageID, n int) *Message {
+	m := messagePool.Get().(*Message)
+	m.ID = id
+	m.pooled = true
+	m.buf = getBuffer(n)
+	m.Payload = *m.buf
+	return m
+}
+
+// Release returns a message read by a Reader to the pool. Neither the
+// message nor its payload may be used afterwards. Messages built any other
+// way are left alone.
+func (m *Message) Release() {
+	if m == nil || !m.pooled {
+		return
+	}
+	putBuffer(m.buf)
+	*m = Message{}
+	messagePool.Put(m)
+}
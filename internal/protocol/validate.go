@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Size limits enforced on incoming messages
+const (
+	// MaxMessageLength bounds the length prefix Read accepts, which leaves
+	// room for the bitfield of about eight million pieces
+	MaxMessageLength = 1 << 20
+	// MaxBlockLength is the largest block a request or piece may carry
+	MaxBlockLength = 128 * 1024
+)
+
+// ProtocolError reports a message that violates the wire protocol. Peers
+// sending one are disconnected.
+type ProtocolError struct {
+	Message string // name of the offending message, empty when unknown
+	Reason  string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Message == "" {
+		return "protocol violation: " + e.Reason
+	}
+	return fmt.Sprintf("protocol violation in %s message: %s", e.Message, e.Reason)
+}
+
+func violation(msg *Message, format string, args ...any) error {
+	return &ProtocolError{Message: msg.name(), Reason: fmt.Sprintf(format, args...)}
+}
+
+// Limits describes the torrent a connection is for, to validate messages
+// against
+type Limits struct {
+	NumPieces int
+	PieceSize func(index int) int
+}
+
+// payloadLengths are the exact payload lengths of fixed size messages
+var payloadLengths = map[MessageID]int{
+	MsgChoke:        0,
+	MsgUnchoke:      0,
+	MsgInterested:   0,
+	MsgUnInterested: 0,
+	MsgHave:         4,
+	MsgRequest:      12,
+	MsgCancel:       12,
+}
+
+// Validate checks the payload length of msg for its ID, that piece indices
+// are in range and that blocks lie within their piece. Keep-alives and
+// unknown messages are accepted.
+func (l *Limits) Validate(msg *Message) error {
+	if msg == nil {
+		return nil
+	}
+	if want, ok := payloadLengths[msg.ID]; ok && len(msg.Payload) != want {
+		return violation(msg, "payload is %d bytes, want %d", len(msg.Payload), want)
+	}
+
+	switch msg.ID {
+	case MsgHave:
+		return l.checkIndex(msg, binary.BigEndian.Uint32(msg.Payload))
+	case MsgBitfield:
+		return l.ValidateBitfield(Bitfield(msg.Payload))
+	case MsgRequest, MsgCancel:
+		index := binary.BigEndian.Uint32(msg.Payload[0:4])
+		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+		length := binary.BigEndian.Uint32(msg.Payload[8:12])
+		return l.checkBlock(msg, index, begin, length)
+	case MsgPiece:
+		if len(msg.Payload) < 8 {
+			return violation(msg, "payload is %d bytes, want at least 8", len(msg.Payload))
+		}
+		index := binary.BigEndian.Uint32(msg.Payload[0:4])
+		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+		return l.checkBlock(msg, index, begin, uint32(len(msg.BlockData())))
+	case MsgExtended:
+		if len(msg.Payload) < 1 {
+			return violation(msg, "missing extended message ID")
+		}
+	case MsgHashRequest, MsgHashReject:
+		if len(msg.Payload) != hashRequestLen {
+			return violation(msg, "payload is %d bytes, want %d", len(msg.Payload), hashRequestLen)
+		}
+	case MsgHashes:
+		if len(msg.Payload) < hashRequestLen || (len(msg.Payload)-hashRequestLen)%32 != 0 {
+			return violation(msg, "payload of %d bytes is not a list of hashes", len(msg.Payload))
+		}
+	}
+	return nil
+}
+
+// ValidateBitfield checks that bf has one bit per piece and that the spare
+// bits of its last byte are clear
+func (l *Limits) ValidateBitfield(bf Bitfield) error {
+	msg := &Message{ID: MsgBitfield}
+	if want := (l.NumPieces + 7) / 8; len(bf) != want {
+		return violation(msg, "%d bytes for %d pieces, want %d", len(bf), l.NumPieces, want)
+	}
+	if spare := len(bf)*8 - l.NumPieces; spare > 0 && bf[len(bf)-1]&(1<<spare-1) != 0 {
+		return violation(msg, "spare bits set")
+	}
+	return nil
+}
+
+func (l *Limits) checkIndex(msg *Message, index uint32) error {
+	if uint64(index) >= uint64(l.NumPieces) {
+		return violation(msg, "piece index %d out of range, torrent has %d pieces", index, l.NumPieces)
+	}
+	return nil
+}
+
+func (l *Limits) checkBlock(msg *Message, index, begin, length uint32) error {
+	if err := l.checkIndex(msg, index); err != nil {
+		return err
+	}
+	if length == 0 || length > MaxBlockLength {
+		return violation(msg, "block length %d outside 1..%d", length, MaxBlockLength)
+	}
+	if size := l.PieceSize(int(index)); uint64(begin)+uint64(length) > uint64(size) {
+		return violation(msg, "block %d+%d beyond the %d bytes of piece %d", begin, length, size, index)
+	}
+	return nil
+}
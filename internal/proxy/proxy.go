@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"btc/internal/config"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Category is a kind of traffic the proxy can be enabled for
+type Category int
+
+const (
+	Peers Category = iota
+	Trackers
+	WebSeeds
+)
+
+// ErrUDPUnsupported is returned for UDP through a proxy that can only
+// relay TCP
+var ErrUDPUnsupported = errors.New("proxy cannot relay UDP")
+
+// Proxy connects through a SOCKS5 or HTTP CONNECT proxy. Credentials are
+// taken from the URL. Host names are resolved by the proxy.
+type Proxy struct {
+	URL     *url.URL
+	Timeout time.Duration
+}
+
+// Parse checks a proxy URL of the form socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port
+func Parse(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy URL %q needs a host and port", rawURL)
+	}
+	return u, nil
+}
+
+// For returns the proxy configured for traffic of the given category, or
+// nil when that traffic goes direct
+func For(cfg *config.Config, c Category, timeout time.Duration) (*Proxy, error) {
+	if cfg.ProxyURL == "" {
+		return nil, nil
+	}
+	switch {
+	case c == Peers && !cfg.ProxyPeers,
+		c == Trackers && !cfg.ProxyTrackers,
+		c == WebSeeds && !cfg.ProxyWebSeeds:
+		return nil, nil
+	}
+	u, err := Parse(cfg.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{URL: u, Timeout: timeout}, nil
+}
+
+// Dial connects to addr over TCP, through the proxy when one is configured
+// for c
+func Dial(cfg *config.Config, c Category, addr string, timeout time.Duration) (net.Conn, error) {
+	p, err := For(cfg, c, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.DialContext(ctx, "tcp", addr)
+}
+
+// DialUDP returns a connected UDP socket to addr, relayed by the proxy when
+// one is configured for c
+func DialUDP(cfg *config.Config, c Category, addr string, timeout time.Duration) (net.Conn, error) {
+	p, err := For(cfg, c, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return net.Dial("udp", addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.DialUDP(ctx, addr)
+}
+
+// DialContext connects to addr through the proxy. Only tcp is supported.
+func (p *Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("proxying %s is not supported", network)
+	}
+	conn, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tunnel := conn
+	if p.URL.Scheme == "http" {
+		tunnel, err = httpConnect(conn, addr, p.URL.User)
+	} else {
+		_, err = socksRequest(conn, socksConnect, addr, p.URL.User)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to %s through proxy: %w", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// DialUDP returns a UDP socket to addr relayed through a SOCKS5 UDP
+// association
+func (p *Proxy) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	if p.URL.Scheme == "http" {
+		return nil, ErrUDPUnsupported
+	}
+	ctrl, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := socksAssociate(ctrl, addr, p.URL)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("relaying UDP to %s through proxy: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// dialProxy opens a connection to the proxy with a deadline for the
+// proxy handshake
+func (p *Proxy) dialProxy(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: p.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", p.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to proxy: %w", err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok && p.Timeout > 0 {
+		deadline = time.Now().Add(p.Timeout)
+	}
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[string]*http.Transport)
+)
+
+// HTTPClient returns a client going through the proxy when one is
+// configured for c. Transports are shared per proxy so idle connections
+// are reused.
+func HTTPClient(cfg *config.Config, c Category, timeout time.Duration) (*http.Client, error) {
+	p, err := For(cfg, c, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	return &http.Client{Timeout: timeout, Transport: p.transport()}, nil
+}
+
+func (p *Proxy) transport() *http.Transport {
+	key := p.URL.String()
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if t, ok := transports[key]; ok {
+		return t
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if p.URL.Scheme == "http" {
+		// Plain requests are forwarded, https goes through CONNECT
+		t.Proxy = http.ProxyURL(p.URL)
+	} else {
+		t.Proxy = nil
+		t.DialContext = p.DialContext
+	}
+	transports[key] = t
+	return t
+}
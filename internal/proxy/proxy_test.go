@@ -0,0 +1,343 @@
+package proxy
+
+import (
+	"btc/internal/config"
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen starts serving connections on a local port until the test ends
+func listen(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoServer returns the address of a TCP server echoing what it reads
+func echoServer(t *testing.T) string {
+	return listen(t, func(conn net.Conn) { io.Copy(conn, conn) })
+}
+
+// udpEchoServer returns the address of a UDP server echoing datagrams
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// socksServer returns the address of a SOCKS5 proxy requiring user and
+// password, supporting CONNECT and UDP ASSOCIATE to IPv4 and domain
+// addresses
+func socksServer(t *testing.T, user, password string) string {
+	return listen(t, func(conn net.Conn) {
+		buf := make([]byte, 256)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		methods := buf[:buf[1]]
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		if !containsByte(methods, socksUserPassword) {
+			conn.Write([]byte{socksVersion, socksNoAcceptable})
+			return
+		}
+		conn.Write([]byte{socksVersion, socksUserPassword})
+
+		gotUser, ok := readSocksString(conn, 1)
+		if !ok {
+			return
+		}
+		gotPassword, ok := readSocksString(conn, 0)
+		if !ok {
+			return
+		}
+		if gotUser != user || gotPassword != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+			return
+		}
+		cmd := buf[1]
+		dst, err := readSocksAddr(conn)
+		if err != nil {
+			return
+		}
+		if dst.IP == nil {
+			// A domain name, which the tests only use for localhost
+			dst.IP = net.IPv4(127, 0, 0, 1)
+		}
+		switch cmd {
+		case socksConnect:
+			up, err := net.Dial("tcp", dst.String())
+			if err != nil {
+				conn.Write([]byte{socksVersion, 5, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer up.Close()
+			conn.Write([]byte{socksVersion, 0, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+			go io.Copy(up, conn)
+			io.Copy(conn, up)
+		case socksUDPAssociate:
+			relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				return
+			}
+			defer relay.Close()
+			// Reply with an unspecified address, the client uses ours
+			reply := []byte{socksVersion, 0, 0, socksIPv4, 0, 0, 0, 0}
+			reply = binary.BigEndian.AppendUint16(reply, uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+			conn.Write(reply)
+			go relayUDP(relay)
+			io.Copy(io.Discard, conn)
+		default:
+			conn.Write([]byte{socksVersion, 7, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+		}
+	})
+}
+
+// relayUDP forwards datagrams from the first client to the address in
+// their header, and datagrams from anyone else back to the client
+func relayUDP(relay *net.UDPConn) {
+	buf := make([]byte, 1500)
+	var client *net.UDPAddr
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := &byteReader{b: buf[3:n]}
+			dst, err := readSocksAddr(r)
+			if err != nil {
+				continue
+			}
+			if dst.IP == nil {
+				dst.IP = net.IPv4(127, 0, 0, 1)
+			}
+			relay.WriteToUDP(r.b, dst)
+			continue
+		}
+		packet := []byte{0, 0, 0, socksIPv4}
+		packet = append(packet, from.IP.To4()...)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(from.Port))
+		relay.WriteToUDP(append(packet, buf[:n]...), client)
+	}
+}
+
+// byteReader reads from b, leaving the unread rest in b
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// readSocksString reads a length prefixed string after skip other bytes
+func readSocksString(r io.Reader, skip int) (string, bool) {
+	buf := make([]byte, 255+skip)
+	if _, err := io.ReadFull(r, buf[:skip+1]); err != nil {
+		return "", false
+	}
+	s := buf[:buf[skip]]
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", false
+	}
+	return string(s), true
+}
+
+func containsByte(b []byte, c byte) bool {
+	for _, x := range b {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+// httpProxy returns the address of an HTTP proxy tunnelling CONNECT
+// requests that carry the given Basic credentials
+func httpProxy(t *testing.T, user, password string) string {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return listen(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect {
+			io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		up, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer up.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		go io.Copy(up, br)
+		io.Copy(conn, up)
+	})
+}
+
+// assertEcho checks that a message sent over conn comes back
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("got %q back, want %q", buf[:n], "ping")
+	}
+}
+
+func proxyConfig(rawURL string) *config.Config {
+	cfg := config.Default()
+	cfg.ProxyURL = rawURL
+	return cfg
+}
+
+func TestDialTunnel(t *testing.T) {
+	target := echoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	tests := []struct {
+		name string
+		url  string
+		addr string
+	}{
+		{"socks5", "socks5://u:p@" + socksServer(t, "u", "p"), target},
+		{"socks5 host name", "socks5://u:p@" + socksServer(t, "u", "p"), net.JoinHostPort("localhost", port)},
+		{"http", "http://u:p@" + httpProxy(t, "u", "p"), target},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := Dial(proxyConfig(tt.url), Peers, tt.addr, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn)
+		})
+	}
+}
+
+func TestDialAuthFailure(t *testing.T) {
+	target := echoServer(t)
+	socks := socksServer(t, "u", "p")
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"socks5 wrong password", "socks5://u:x@" + socks},
+		{"socks5 no credentials", "socks5://" + socks},
+		{"http wrong password", "http://u:x@" + httpProxy(t, "u", "p")},
+		{"http no credentials", "http://" + httpProxy(t, "u", "p")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := Dial(proxyConfig(tt.url), Peers, target, time.Second)
+			if err == nil {
+				conn.Close()
+				t.Fatal("dial succeeded without valid credentials")
+			}
+		})
+	}
+}
+
+func TestDialUDP(t *testing.T) {
+	echo := udpEchoServer(t)
+	cfg := proxyConfig("socks5://u:p@" + socksServer(t, "u", "p"))
+	conn, err := DialUDP(cfg, Trackers, net.JoinHostPort("localhost", strconv.Itoa(echo.Port)), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	cfg = proxyConfig("socks5://u:x@" + socksServer(t, "u", "p"))
+	if _, err := DialUDP(cfg, Trackers, echo.String(), time.Second); err == nil {
+		t.Error("UDP association succeeded without valid credentials")
+	}
+	cfg = proxyConfig("http://u:p@" + httpProxy(t, "u", "p"))
+	if _, err := DialUDP(cfg, Trackers, echo.String(), time.Second); !errors.Is(err, ErrUDPUnsupported) {
+		t.Errorf("UDP through an HTTP proxy returned %v, want %v", err, ErrUDPUnsupported)
+	}
+}
+
+func TestFor(t *testing.T) {
+	cfg := proxyConfig("socks5://127.0.0.1:1080")
+	cfg.ProxyWebSeeds = false
+	for _, c := range []Category{Peers, Trackers} {
+		if p, err := For(cfg, c, time.Second); err != nil || p == nil {
+			t.Errorf("category %d: got %v, %v, want the proxy", c, p, err)
+		}
+	}
+	if p, err := For(cfg, WebSeeds, time.Second); err != nil || p != nil {
+		t.Errorf("disabled category: got %v, %v, want no proxy", p, err)
+	}
+
+	for _, bad := range []string{"ftp://127.0.0.1:21", "socks5://127.0.0.1", "http://:8080"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+}
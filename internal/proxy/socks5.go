@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksUserPassword = 0x02
+	socksNoAcceptable = 0xff
+
+	socksConnect      = 0x01
+	socksUDPAssociate = 0x03
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksRequest authenticates and sends a command for addr, returning the
+// address bound by the proxy
+func socksRequest(conn net.Conn, cmd byte, addr string, user *url.Userinfo) (*net.UDPAddr, error) {
+	if err := socksAuth(conn, user); err != nil {
+		return nil, err
+	}
+
+	req := []byte{socksVersion, cmd, 0}
+	req, err := appendSocksAddr(req, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var head [3]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, fmt.Errorf("reading SOCKS reply: %w", err)
+	}
+	if head[0] != socksVersion {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", head[0])
+	}
+	if head[1] != 0 {
+		reason, ok := socksReplies[head[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %d", head[1])
+		}
+		return nil, fmt.Errorf("SOCKS proxy: %s", reason)
+	}
+	return readSocksAddr(conn)
+}
+
+// socksAuth negotiates no authentication, or username and password when
+// the URL has credentials
+func socksAuth(conn net.Conn, user *url.Userinfo) error {
+	methods := []byte{socksVersion, 1, socksNoAuth}
+	if user != nil {
+		methods = []byte{socksVersion, 2, socksNoAuth, socksUserPassword}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("reading SOCKS greeting: %w", err)
+	}
+	if resp[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case socksNoAuth:
+		return nil
+	case socksUserPassword:
+		if user == nil {
+			return errors.New("SOCKS proxy requires a username and password")
+		}
+		name := user.Username()
+		password, _ := user.Password()
+		if len(name) > 255 || len(password) > 255 {
+			return errors.New("SOCKS username or password too long")
+		}
+		req := []byte{1, byte(len(name))}
+		req = append(req, name...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return fmt.Errorf("reading SOCKS authentication reply: %w", err)
+		}
+		if resp[1] != 0 {
+			return errors.New("SOCKS authentication failed")
+		}
+		return nil
+	case socksNoAcceptable:
+		return errors.New("SOCKS proxy accepted none of our authentication methods")
+	default:
+		return fmt.Errorf("SOCKS proxy chose unknown authentication method %d", resp[1])
+	}
+}
+
+// appendSocksAddr appends addr as a SOCKS address, sending host names for
+// the proxy to resolve
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %q", host)
+		}
+		b = append(b, socksDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocksAddr reads a SOCKS address. Domain names are left unresolved
+// and returned as a nil IP.
+func readSocksAddr(r io.Reader) (*net.UDPAddr, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return nil, err
+	}
+	var host []byte
+	switch atyp[0] {
+	case socksIPv4:
+		host = make([]byte, 4)
+	case socksIPv6:
+		host = make([]byte, 16)
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		host = make([]byte, n[0])
+	default:
+		return nil, fmt.Errorf("unknown SOCKS address type %d", atyp[0])
+	}
+	if _, err := io.ReadFull(r, host); err != nil {
+		return nil, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	addr := &net.UDPAddr{Port: int(binary.BigEndian.Uint16(port[:]))}
+	if atyp[0] != socksDomain {
+		addr.IP = net.IP(host)
+	}
+	return addr, nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// udpHeaderMax is the largest SOCKS UDP request header, with a 255 byte
+// domain name
+const udpHeaderMax = 3 + 1 + 1 + 255 + 2
+
+// udpConn is a UDP socket to one destination, relayed by a SOCKS5 proxy.
+// The association lasts as long as the control connection.
+type udpConn struct {
+	*net.UDPConn
+	ctrl   net.Conn
+	header []byte // request header addressing the destination
+}
+
+// socksAssociate sets up a UDP association on ctrl and returns a socket
+// sending to addr through it
+func socksAssociate(ctrl net.Conn, addr string, u *url.URL) (net.Conn, error) {
+	header, err := appendSocksAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return nil, err
+	}
+	// We do not know our address as the proxy sees it, so leave it open
+	relay, err := socksRequest(ctrl, socksUDPAssociate, "0.0.0.0:0", u.User)
+	if err != nil {
+		return nil, err
+	}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		tcp, ok := ctrl.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("cannot tell the relay address of the proxy")
+		}
+		relay.IP = tcp.IP
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		return nil, fmt.Errorf("contacting UDP relay: %w", err)
+	}
+	ctrl.SetDeadline(time.Time{})
+	return &udpConn{UDPConn: conn, ctrl: ctrl, header: header}, nil
+}
+
+// Write sends b to the destination through the relay
+func (c *udpConn) Write(b []byte) (int, error) {
+	packet := make([]byte, 0, len(c.header)+len(b))
+	packet = append(packet, c.header...)
+	packet = append(packet, b...)
+	if _, err := c.UDPConn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read receives the next datagram relayed back, without its SOCKS header.
+// Fragmented datagrams are dropped.
+func (c *udpConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+udpHeaderMax)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		if _, err := readSocksAddr(r); err != nil {
+			continue
+		}
+		return r.Read(b)
+	}
+}
+
+// Close ends the association
+func (c *udpConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
@@ -3,36 +3,131 @@ package storage
 import (
 	"btc/internal/logger"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
+// FileSpec describes one file of the torrent content on disk. Pad files
+// are never created: writes to them are dropped and reads return zeros.
+type FileSpec struct {
+	Path   string
+	Length int64
+	Pad    bool
+}
+
+// storageFile is a file opened lazily the first time it is touched, so that
+// files excluded from a download are never created unless a shared boundary
+// piece writes into them.
+type storageFile struct {
+	FileSpec
+	offset int64
+	file   *os.File
+}
+
+// FileStorage maps the linear torrent content onto one or more files
 type FileStorage struct {
-	file     *os.File
+	mu       sync.Mutex
+	files    []*storageFile
+	truncate bool
 	pieceLen int
 	totalLen int
 	bitfield []bool
 }
 
-func NewFileStorage(path string, plen int, tlen int) (*FileStorage, error) {
+// NewFileStorage creates the output files, discarding any existing contents
+func NewFileStorage(files []FileSpec, plen int) (*FileStorage, error) {
+	return newFileStorage(files, plen, true)
+}
 
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+// OpenFileStorage opens the output files keeping existing contents, used when resuming
+func OpenFileStorage(files []FileSpec, plen int) (*FileStorage, error) {
+	return newFileStorage(files, plen, false)
+}
+
+func newFileStorage(files []FileSpec, plen int, truncate bool) (*FileStorage, error) {
+	fs := &FileStorage{
+		pieceLen: plen,
+		truncate: truncate,
+	}
+	var offset int64
+	for _, spec := range files {
+		fs.files = append(fs.files, &storageFile{FileSpec: spec, offset: offset})
+		offset += spec.Length
+	}
+	fs.totalLen = int(offset)
+	fs.bitfield = make([]bool, (fs.totalLen+plen-1)/plen)
+	return fs, nil
+}
+
+// open returns the handle for f, creating the file and its directories if needed
+func (fs *FileStorage) open(f *storageFile) (*os.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if f.file != nil {
+		return f.file, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return nil, err
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if fs.truncate {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(f.Path, flags, 0644)
 	if err != nil {
-		logger.Error("failed to open file ", "path", path, "error", err)
+		logger.Error("failed to open file ", "path", f.Path, "error", err)
+		return nil, err
+	}
+	if err := file.Truncate(f.Length); err != nil {
+		file.Close()
 		return nil, err
 	}
+	f.file = file
+	return file, nil
+}
 
-	return &FileStorage{
-		file:     file,
-		pieceLen: plen,
-		totalLen: tlen,
-		bitfield: make([]bool, (tlen+plen-1)/plen),
-	}, nil
+// span reads or writes each file section overlapping [offset, offset+len(buf))
+func (fs *FileStorage) span(buf []byte, offset int64, read bool) error {
+	for _, f := range fs.files {
+		if len(buf) == 0 {
+			break
+		}
+		end := f.offset + f.Length
+		if offset >= end || f.Length == 0 {
+			continue
+		}
+		n := min(int64(len(buf)), end-offset)
+		switch {
+		case f.Pad && read:
+			clear(buf[:n])
+		case f.Pad:
+		default:
+			file, err := fs.open(f)
+			if err != nil {
+				return err
+			}
+			if read {
+				_, err = file.ReadAt(buf[:n], offset-f.offset)
+			} else {
+				_, err = file.WriteAt(buf[:n], offset-f.offset)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		buf = buf[n:]
+		offset += n
+	}
+	return nil
 }
 
 func (fs *FileStorage) WritePiece(index int, buf []byte) error {
 
-	var offset int64 = int64(index * fs.pieceLen)
+	var offset int64 = int64(index) * int64(fs.pieceLen)
 
-	_, err := fs.file.WriteAt(buf, offset)
+	err := fs.span(buf, offset, false)
 	if err != nil {
 		return err
 	}
@@ -40,6 +135,27 @@ func (fs *FileStorage) WritePiece(index int, buf []byte) error {
 	return nil
 }
 
+// WriteBlock writes a single block of a piece that has not been verified yet
+func (fs *FileStorage) WriteBlock(index, begin int, buf []byte) error {
+	offset := int64(index)*int64(fs.pieceLen) + int64(begin)
+	return fs.span(buf, offset, false)
+}
+
+// ReadBlock reads len(buf) bytes of a piece starting at begin
+func (fs *FileStorage) ReadBlock(index, begin int, buf []byte) error {
+	offset := int64(index)*int64(fs.pieceLen) + int64(begin)
+	return fs.span(buf, offset, true)
+}
+
+// ReadAt reads torrent content at an absolute offset
+func (fs *FileStorage) ReadAt(buf []byte, offset int64) (int, error) {
+	err := fs.span(buf, offset, true)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
 func (fs *FileStorage) HasPiece(index int) bool {
 	// checking index validity
 	if index < 0 || index >= len(fs.bitfield) {
@@ -49,5 +165,18 @@ func (fs *FileStorage) HasPiece(index int) bool {
 }
 
 func (fs *FileStorage) Close() error {
-	return fs.file.Close()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var firstErr error
+	for _, f := range fs.files {
+		if f.file == nil {
+			continue
+		}
+		if err := f.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		f.file = nil
+	}
+	return firstErr
 }
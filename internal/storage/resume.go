@@ -2,28 +2,57 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 )
 
+// ResumeVersion is the schema version written by SaveResume.
+// Files written before versioning was introduced decode with Version 0.
+const ResumeVersion = 1
+
+// ErrResumeVersion is returned when a resume file has a schema we cannot read
+var ErrResumeVersion = errors.New("unsupported resume file version")
+
 // ResumeData holds the state needed to resume an interrupted download
 type ResumeData struct {
+	Version         int      `json:"version"`
 	InfoHash        [20]byte `json:"info_hash"`
+	PieceLength     int      `json:"piece_length"`
+	BlockSize       int      `json:"block_size"`
 	CompletedPieces []bool   `json:"completed_pieces"`
-	DownloadedBytes int64    `json:"downloaded_bytes"`
+	// PartialPieces maps an incomplete piece index to the blocks already on disk
+	PartialPieces   map[int][]bool `json:"partial_pieces,omitempty"`
+	DownloadedBytes int64          `json:"downloaded_bytes"`
 }
 
-// SaveResume writes resume data to the specified path
+// SaveResume atomically writes resume data to the specified path
 func SaveResume(path string, data *ResumeData) error {
-	file, err := os.Create(path)
+	data.Version = ResumeVersion
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	tmpPath := file.Name()
+
+	err = json.NewEncoder(file).Encode(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
 
-	return json.NewEncoder(file).Encode(data)
+	return os.Rename(tmpPath, path)
 }
 
-// LoadResume reads resume data from the specified path
+// LoadResume reads resume data from the specified path, migrating older schemas
 func LoadResume(path string) (*ResumeData, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -37,6 +66,19 @@ func LoadResume(path string) (*ResumeData, error) {
 		return nil, err
 	}
 
+	switch data.Version {
+	case 0:
+		// Version 0 only tracked whole pieces, and its byte count assumed every
+		// piece was full length, so drop it and let the caller recompute. The
+		// version is kept: its output files were truncated on every run, so
+		// callers must hash the completed pieces again before trusting them.
+		data.PartialPieces = nil
+		data.DownloadedBytes = 0
+	case ResumeVersion:
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrResumeVersion, data.Version)
+	}
+
 	return &data, nil
 }
 
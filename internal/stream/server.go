@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"btc/internal/download"
+	"btc/internal/logger"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// fileEntry describes a served file in the index listing
+type fileEntry struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	URL    string `json:"url"`
+}
+
+// Server serves the files of a torrent over HTTP with Range support while it
+// downloads. Requested ranges are prioritised by the download.
+type Server struct {
+	t   *download.Torrent
+	mux *http.ServeMux
+}
+
+// NewServer creates a server for an opened torrent
+func NewServer(t *download.Torrent) *Server {
+	s := &Server{t: t, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /{$}", s.handleIndex)
+	s.mux.HandleFunc("GET /files/{path...}", s.handleFile)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleIndex lists the files of the torrent as JSON
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	entries := make([]fileEntry, 0, len(s.t.Files))
+	for _, f := range s.t.Files {
+		if f.Pad {
+			continue
+		}
+		entries = append(entries, fileEntry{
+			Path:   f.Path,
+			Length: f.Length,
+			URL:    "/files/" + (&url.URL{Path: f.Path}).EscapedPath(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// handleFile streams a single file, honouring Range requests
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("path")
+	var file *download.File
+	for i := range s.t.Files {
+		if s.t.Files[i].Path == name && !s.t.Files[i].Pad {
+			file = &s.t.Files[i]
+			break
+		}
+	}
+	if file == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	reader, err := s.t.NewReader(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer reader.Close()
+
+	// Set the type up front so ServeContent does not block sniffing content
+	contentType := mime.TypeByExtension(path.Ext(file.Path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	logger.Debug("streaming file", "path", file.Path, "range", r.Header.Get("Range"))
+	content := io.NewSectionReader(reader, file.Offset, file.Length)
+	http.ServeContent(w, r, path.Base(file.Path), time.Time{}, content)
+}
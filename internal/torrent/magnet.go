@@ -0,0 +1,87 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet holds the fields of a magnet link (BEP 9, BEP 52 for btmh)
+type Magnet struct {
+	InfoHash   [20]byte
+	HasV1      bool
+	InfoHashV2 [32]byte
+	HasV2      bool
+	Name       string
+	Length     int64 // 0 when the link has no xl
+	Trackers   []string
+	WebSeeds   []string
+}
+
+// ParseMagnet parses a magnet URI carrying a btih and/or btmh exact topic
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parsing magnet link: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %q", uri)
+	}
+
+	q := u.Query()
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		WebSeeds: q["ws"],
+	}
+	if xl := q.Get("xl"); xl != "" {
+		m.Length, err = strconv.ParseInt(xl, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet length %q", xl)
+		}
+	}
+
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			if err := decodeBTIH(strings.TrimPrefix(xt, "urn:btih:"), &m.InfoHash); err != nil {
+				return nil, err
+			}
+			m.HasV1 = true
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			// multihash: 0x12 (sha2-256), 0x20 (32 bytes), digest
+			raw, err := hex.DecodeString(strings.TrimPrefix(xt, "urn:btmh:"))
+			if err != nil || len(raw) != 34 || raw[0] != 0x12 || raw[1] != 0x20 {
+				return nil, fmt.Errorf("invalid btmh topic %q", xt)
+			}
+			copy(m.InfoHashV2[:], raw[2:])
+			m.HasV2 = true
+		}
+	}
+	if !m.HasV1 && !m.HasV2 {
+		return nil, fmt.Errorf("magnet link has no btih or btmh topic")
+	}
+	return m, nil
+}
+
+// decodeBTIH accepts the 40 character hex or 32 character base32 forms
+func decodeBTIH(s string, out *[20]byte) error {
+	var raw []byte
+	var err error
+	switch len(s) {
+	case 40:
+		raw, err = hex.DecodeString(s)
+	case 32:
+		raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = fmt.Errorf("unexpected length %d", len(s))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid btih topic %q: %w", s, err)
+	}
+	copy(out[:], raw)
+	return nil
+}
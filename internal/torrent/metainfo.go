@@ -1,82 +1,211 @@
 package torrent
 
 import (
+	"btc/internal/bencode"
 	"btc/internal/config"
 	"btc/internal/download"
+	"btc/internal/ipfilter"
+	"btc/internal/listener"
 	"btc/internal/logger"
+	"btc/internal/lsd"
+	"btc/internal/peer"
 	"btc/internal/tracker"
-	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
-
-	"github.com/jackpal/bencode-go"
+	"path"
+	"strings"
+	"time"
 )
 
+// File entry of a multi-file info dict
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr,omitempty"`
+}
+
 // Info dict struct
 type bencodeInfo struct {
-	Name        string `bencode:"name"`
-	Pieces      string `bencode:"pieces"`
-	Length      int    `bencode:"length"`
-	PieceLength int    `bencode:"piece length"`
+	Name        string         `bencode:"name"`
+	Pieces      string         `bencode:"pieces"`
+	Length      int            `bencode:"length,omitempty"`
+	Files       []bencodeFile  `bencode:"files,omitempty"`
+	PieceLength int            `bencode:"piece length"`
+	MetaVersion int            `bencode:"meta version,omitempty"`
+	FileTree    map[string]any `bencode:"file tree,omitempty"`
+	Private     bool           `bencode:"private,omitempty"`
+	Extra       map[string]any `bencode:",extra"`
 }
 
 // Represents a .torrent file (Only relevant parameters)
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list"`
+	Comment      string     `bencode:"comment"`
+	CreatedBy    string     `bencode:"created by"`
+	CreationDate int64      `bencode:"creation date"`
+	// RawInfo holds the exact bytes of the info dictionary, which are hashed
+	RawInfo     bencode.RawMessage `bencode:"info"`
+	Info        bencodeInfo        `bencode:"-"`
+	URLList     any                `bencode:"url-list"` // a single string or a list of strings
+	HTTPSeeds   []string           `bencode:"httpseeds"`
+	PieceLayers map[string]string  `bencode:"piece layers"`
+	Extra       map[string]any     `bencode:",extra"`
+}
+
+// File is a file of a torrent, with a slash separated path relative to the
+// torrent root. Pad files align the next file to a piece boundary (BEP 47).
+type File struct {
+	Path   string
+	Length int
+	Pad    bool
 }
 
 // TorrentFile contains processed torrent metadata
 type TorrentFile struct {
 	Name        string
 	Announce    string
-	PieceHashes [][20]byte
-	InfoHash    [20]byte
-	PieceLength int
-	Length      int
+	PieceHashes [][20]byte // empty for v2-only torrents
+	// InfoHash identifies the swarm: the v1 hash, or the truncated v2 hash
+	// for v2-only torrents
+	InfoHash     [20]byte
+	InfoHashV2   [32]byte
+	MetaVersion  int
+	PieceRootsV2 []download.PieceRootV2
+	PieceLayers  map[[32]byte][][32]byte
+	PieceLength  int
+	Length       int
+	Files        []File
+	MultiFile    bool
+	WebSeeds     []string // BEP 19 url-list
+	HTTPSeeds    []string // BEP 17 httpseeds
+	// AnnounceList holds the BEP 12 tracker tiers, empty when only Announce is set
+	AnnounceList [][]string
+	Private      bool
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // zero when absent
+	// RawInfo is the info dictionary exactly as it appeared in the file
+	RawInfo []byte
+	// Extra and InfoExtra hold metainfo and info keys not modelled above
+	Extra     map[string]any
+	InfoExtra map[string]any
 }
 
 // For wiring progress and events tracking into ui
 type DownloadOptions struct {
 	OnProgress download.ProgressCallback
 	OnEvent    download.EventCallback
+	// Only and Exclude select files by path.Match glob, see download.Torrent.SelectFiles
+	Only    []string
+	Exclude []string
+	// LSD, when set, is used to find peers on the local network
+	LSD *lsd.Service
+	// IPFilter, when set, blocks peers in its address ranges
+	IPFilter *ipfilter.Filter
+	// Listener, when set, passes incoming peer connections to the download
+	Listener *listener.Listener
 }
 
-// DownloadToFile downloads the torrent and saves it to the specified path
-func (t *TorrentFile) DownloadToFile(ctx context.Context, path string, cfg *config.Config, opts *DownloadOptions) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+// Prepare opens the download at path, so the tracker learns how much of it
+// is left, and announces it. The returned torrent is ready to run and
+// must be closed by the caller. Use it instead of DownloadToFile to read
+// content while it downloads.
+func (t *TorrentFile) Prepare(path string, cfg *config.Config, opts *DownloadOptions) (*download.Torrent, error) {
+	peerID, err := peer.GeneratePeerID()
 	if err != nil {
-		return fmt.Errorf("generating peer ID: %w", err)
+		return nil, err
+	}
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("generating announce key: %w", err)
 	}
 
-	logger.Info("requesting peers from tracker", "announce", t.Announce)
 	httpTracker := tracker.NewHTTPTracker(t.Announce, cfg)
-	peers, err := httpTracker.Announce(peerID, 8080, t.InfoHash, t.Length)
-	if err != nil {
-		return fmt.Errorf("requesting peers: %w", err)
+	torrent := &download.Torrent{
+		Tracker:      httpTracker,
+		PeerID:       peerID,
+		AnnounceKey:  binary.BigEndian.Uint32(key[:]),
+		InfoHash:     t.InfoHash,
+		PieceHashes:  t.PieceHashes,
+		PieceRootsV2: t.PieceRootsV2,
+		PieceLayers:  t.PieceLayers,
+		PieceLength:  t.PieceLength,
+		Length:       t.Length,
+		Name:         t.Name,
+		MultiFile:    t.MultiFile,
+		Private:      t.Private,
+		WebSeeds:     t.WebSeeds,
+		HTTPSeeds:    t.HTTPSeeds,
+		Cfg:          cfg,
+	}
+	if t.IsHybrid() {
+		copy(torrent.HybridInfoHash[:], t.InfoHashV2[:20])
 	}
-	logger.Info("received peers", "count", len(peers))
 
-	torrent := download.Torrent{
-		Peers:       peers,
-		PeerID:      peerID,
-		InfoHash:    t.InfoHash,
-		PieceHashes: t.PieceHashes,
-		PieceLength: t.PieceLength,
-		Length:      t.Length,
-		Name:        t.Name,
-		Cfg:         cfg,
+	var offset int64
+	for _, f := range t.Files {
+		torrent.Files = append(torrent.Files, download.File{Path: f.Path, Length: int64(f.Length), Offset: offset, Pad: f.Pad})
+		offset += int64(f.Length)
 	}
 
 	if opts != nil {
 		torrent.OnProgress = opts.OnProgress
 		torrent.OnEvent = opts.OnEvent
+		torrent.Filter = opts.IPFilter
+		if err := torrent.SelectFiles(opts.Only, opts.Exclude); err != nil {
+			return nil, err
+		}
+	}
+	if err := torrent.Open(path); err != nil {
+		return nil, err
 	}
 
+	logger.Info("requesting peers from tracker", "announce", t.Announce)
+	resp, err := torrent.Announce(tracker.EventStarted)
+	if err != nil {
+		if len(t.WebSeeds) == 0 && len(t.HTTPSeeds) == 0 {
+			torrent.Close()
+			return nil, fmt.Errorf("requesting peers: %w", err)
+		}
+		logger.Warn("tracker unavailable, downloading from web seeds", "error", err)
+	} else {
+		torrent.AddPeers(download.SourceTracker, resp.Peers)
+		torrent.Announced(resp)
+	}
+	logger.Info("received peers", "count", len(torrent.Peers), "webseeds", len(t.WebSeeds)+len(t.HTTPSeeds))
+
+	if opts != nil {
+		if opts.Listener != nil {
+			opts.Listener.Add(torrent)
+			torrent.OnStop(func() { opts.Listener.Remove(torrent) })
+		}
+		if opts.LSD != nil && cfg.EnableLSD && torrent.DiscoveryAllowed(download.SourceLSD) {
+			for _, infoHash := range torrent.InfoHashes() {
+				opts.LSD.Add(infoHash, func(peers []peer.Peer) {
+					torrent.AddPeers(download.SourceLSD, peers)
+				})
+				torrent.OnStop(func() { opts.LSD.Remove(infoHash) })
+			}
+		}
+	}
+	return torrent, nil
+}
+
+// DownloadToFile downloads the torrent and saves it to the specified path
+func (t *TorrentFile) DownloadToFile(ctx context.Context, path string, cfg *config.Config, opts *DownloadOptions) error {
+	torrent, err := t.Prepare(path, cfg, opts)
+	if err != nil {
+		return err
+	}
+	defer torrent.Close()
+	go t.WatchSwarm(ctx, cfg, torrent)
+
 	err = torrent.Download(ctx, path)
 	if err != nil {
 		logger.Error(`Issue while downloading file: ` + err.Error())
@@ -87,6 +216,18 @@ func (t *TorrentFile) DownloadToFile(ctx context.Context, path string, cfg *conf
 	return nil
 }
 
+// Trackers returns the announce URLs grouped by tier, falling back to the
+// single announce URL when there is no announce-list
+func (t *TorrentFile) Trackers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
+	}
+	if t.Announce != "" {
+		return [][]string{{t.Announce}}
+	}
+	return nil
+}
+
 // Open parses a .torrent file and returns a TorrentFile
 func Open(path string) (*TorrentFile, error) {
 	logger.Info("opening torrent file", "path", path)
@@ -96,23 +237,30 @@ func Open(path string) (*TorrentFile, error) {
 	}
 	defer file.Close()
 
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading torrent file: %w", err)
+	}
+
 	var bto bencodeTorrent
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(data, &bto)
 	if err != nil {
 		return nil, fmt.Errorf("parsing torrent file: %w", err)
 	}
+	if len(bto.RawInfo) == 0 {
+		return nil, fmt.Errorf("parsing torrent file: missing info dictionary")
+	}
+	err = bencode.Unmarshal(bto.RawInfo, &bto.Info)
+	if err != nil {
+		return nil, fmt.Errorf("parsing info dictionary: %w", err)
+	}
 
-	return bto.ToTorrentFile()
-}
-
-// ComputeInfoHash calculates the SHA1 hash of the info dictionary
-func (info *bencodeInfo) ComputeInfoHash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, info)
+	tf, err := bto.ToTorrentFile()
 	if err != nil {
-		return [20]byte{}, fmt.Errorf("marshaling info dict: %w", err)
+		return nil, err
 	}
-	return sha1.Sum(buf.Bytes()), nil
+	tf.Extra, tf.InfoExtra = bto.Extra, bto.Info.Extra
+	return tf, nil
 }
 
 // SplitPieceHashes splits the pieces string into individual hashes
@@ -134,6 +282,55 @@ func (info *bencodeInfo) SplitPieceHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
+// ParseFiles returns the file list, a single entry for single-file torrents
+func (info *bencodeInfo) ParseFiles() ([]File, int, error) {
+	if len(info.Files) == 0 {
+		return []File{{Path: info.Name, Length: info.Length}}, info.Length, nil
+	}
+
+	files := make([]File, 0, len(info.Files))
+	total := 0
+	for _, f := range info.Files {
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("negative length for file %v", f.Path)
+		}
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("file entry without path")
+		}
+		for _, part := range f.Path {
+			if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+				return nil, 0, fmt.Errorf("unsafe file path %q", f.Path)
+			}
+		}
+		files = append(files, File{Path: path.Join(f.Path...), Length: f.Length, Pad: strings.Contains(f.Attr, "p")})
+		total += f.Length
+	}
+	return files, total, nil
+}
+
+// ParseWebSeeds returns the BEP 19 url-list, which may be a single string or a list
+func (bto *bencodeTorrent) ParseWebSeeds() []string {
+	var urls []string
+	switch v := bto.URLList.(type) {
+	case string:
+		urls = append(urls, v)
+	case []any:
+		for _, item := range v {
+			if u, ok := item.(string); ok {
+				urls = append(urls, u)
+			}
+		}
+	}
+
+	seeds := make([]string, 0, len(urls))
+	for _, u := range urls {
+		if u != "" {
+			seeds = append(seeds, u)
+		}
+	}
+	return seeds
+}
+
 // ToTorrentFile converts a bencodeTorrent to a TorrentFile
 func (bto *bencodeTorrent) ToTorrentFile() (*TorrentFile, error) {
 	pieceHashes, err := bto.Info.SplitPieceHashes()
@@ -141,17 +338,45 @@ func (bto *bencodeTorrent) ToTorrentFile() (*TorrentFile, error) {
 		return nil, err
 	}
 
-	infoHash, err := bto.Info.ComputeInfoHash()
+	infoHash := sha1.Sum(bto.RawInfo)
+
+	files, length, err := bto.Info.ParseFiles()
 	if err != nil {
 		return nil, err
 	}
 
-	return &TorrentFile{
+	tf := &TorrentFile{
 		Name:        bto.Info.Name,
 		Announce:    bto.Announce,
 		PieceHashes: pieceHashes,
 		InfoHash:    infoHash,
 		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-	}, nil
+		Length:      length,
+		Files:       files,
+		MultiFile:   len(bto.Info.Files) > 0,
+		WebSeeds:    bto.ParseWebSeeds(),
+		HTTPSeeds:   bto.HTTPSeeds,
+		MetaVersion: 1,
+		RawInfo:     bto.RawInfo,
+		Private:     bto.Info.Private,
+		Comment:     bto.Comment,
+		CreatedBy:   bto.CreatedBy,
+	}
+	for _, tier := range bto.AnnounceList {
+		if len(tier) > 0 {
+			tf.AnnounceList = append(tf.AnnounceList, tier)
+		}
+	}
+	if bto.CreationDate > 0 {
+		tf.CreationDate = time.Unix(bto.CreationDate, 0)
+	}
+
+	if bto.Info.MetaVersion == 2 {
+		if err := bto.parseV2(tf); err != nil {
+			return nil, err
+		}
+	} else if bto.Info.MetaVersion > 2 {
+		return nil, fmt.Errorf("unsupported meta version %d", bto.Info.MetaVersion)
+	}
+	return tf, nil
 }
@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"btc/internal/config"
+	"btc/internal/download"
+	"btc/internal/logger"
+	"btc/internal/tracker"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ScrapeResult is what one tracker reported, or why it could not be scraped
+type ScrapeResult struct {
+	Tracker string
+	Stats   map[[20]byte]tracker.SwarmStats
+	Err     error
+}
+
+// ScrapeTrackers scrapes each tracker for its info hashes, one request per
+// tracker where the protocol allows. Results are ordered by tracker URL.
+func ScrapeTrackers(cfg *config.Config, requests map[string][][20]byte) []ScrapeResult {
+	trackers := slices.Sorted(maps.Keys(requests))
+	results := make([]ScrapeResult, len(trackers))
+	var wg sync.WaitGroup
+	for i, announce := range trackers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].Tracker = announce
+			scraper, err := tracker.NewScraper(announce, cfg)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i].Stats, results[i].Err = scraper.Scrape(requests[announce])
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Scrape asks all trackers of the torrent for its swarm stats
+func (t *TorrentFile) Scrape(cfg *config.Config) []ScrapeResult {
+	requests := make(map[string][][20]byte)
+	for _, tier := range t.Trackers() {
+		for _, announce := range tier {
+			requests[announce] = [][20]byte{t.InfoHash}
+		}
+	}
+	return ScrapeTrackers(cfg, requests)
+}
+
+// largestSwarm picks the tracker reporting the most peers for infoHash, as
+// trackers only see part of the swarm
+func largestSwarm(results []ScrapeResult, infoHash [20]byte) (tracker.SwarmStats, error) {
+	var best tracker.SwarmStats
+	found := false
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.Tracker, r.Err))
+			continue
+		}
+		s, ok := r.Stats[infoHash]
+		if !ok {
+			continue
+		}
+		if !found || s.Seeders+s.Leechers > best.Seeders+best.Leechers {
+			best, found = s, true
+		}
+	}
+	if !found {
+		errs = append(errs, errors.New("no tracker reported the torrent"))
+		return best, errors.Join(errs...)
+	}
+	return best, nil
+}
+
+// WatchSwarm scrapes the trackers now and every cfg.ScrapeInterval,
+// recording the swarm size in d until ctx is done
+func (t *TorrentFile) WatchSwarm(ctx context.Context, cfg *config.Config, d *download.Torrent) {
+	ticker := time.NewTicker(cfg.ScrapeInterval)
+	defer ticker.Stop()
+	for {
+		stats, err := largestSwarm(t.Scrape(cfg), t.InfoHash)
+		if err != nil {
+			logger.Debug("scrape failed", "error", err)
+		} else {
+			logger.Info("swarm stats", "seeders", stats.Seeders, "leechers", stats.Leechers, "downloaded", stats.Downloaded)
+			d.SetSwarm(download.Swarm{
+				Seeders:    stats.Seeders,
+				Leechers:   stats.Leechers,
+				Downloaded: stats.Downloaded,
+				Updated:    time.Now(),
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
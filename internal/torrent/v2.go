@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"btc/internal/download"
+	"btc/internal/merkle"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+)
+
+// v2File is a file from a BEP 52 file tree
+type v2File struct {
+	Path       []string
+	Length     int
+	PiecesRoot [32]byte
+}
+
+// NumPieces returns the number of pieces, including for v2-only torrents
+func (t *TorrentFile) NumPieces() int {
+	if t.PieceLength == 0 {
+		return 0
+	}
+	return (t.Length + t.PieceLength - 1) / t.PieceLength
+}
+
+// IsHybrid reports whether the torrent has both v1 and v2 metadata, and so
+// joins the swarms of both info hashes
+func (t *TorrentFile) IsHybrid() bool {
+	return t.MetaVersion == 2 && len(t.PieceHashes) > 0
+}
+
+// parseFileTree flattens a file tree in key order, which is the file order
+func parseFileTree(tree map[string]any, prefix []string, out *[]v2File) error {
+	keys := make([]string, 0, len(tree))
+	for k := range tree {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, name := range keys {
+		node, ok := tree[name].(map[string]any)
+		if !ok {
+			return fmt.Errorf("malformed file tree entry %q", name)
+		}
+		if name == "" {
+			if len(prefix) == 0 {
+				return fmt.Errorf("file tree leaf without a path")
+			}
+			length, ok := node["length"].(int64)
+			if !ok || length < 0 {
+				return fmt.Errorf("file %v has no valid length", prefix)
+			}
+			f := v2File{Path: slices.Clone(prefix), Length: int(length)}
+			if length > 0 {
+				root, ok := node["pieces root"].(string)
+				if !ok || len(root) != 32 {
+					return fmt.Errorf("file %v has no valid pieces root", prefix)
+				}
+				copy(f.PiecesRoot[:], root)
+			}
+			*out = append(*out, f)
+			continue
+		}
+		if name == "." || name == ".." {
+			return fmt.Errorf("unsafe file path component %q", name)
+		}
+		if err := parseFileTree(node, append(prefix, name), out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseV2 fills the BEP 52 fields of tf. For hybrid torrents the v1 file
+// list, including its pad files, must describe the same layout.
+func (bto *bencodeTorrent) parseV2(tf *TorrentFile) error {
+	pieceLen := bto.Info.PieceLength
+	if pieceLen < merkle.BlockSize || pieceLen != merkle.NextPow2(pieceLen) {
+		return fmt.Errorf("v2 piece length %d is not a power of two >= 16 KiB", pieceLen)
+	}
+
+	tf.InfoHashV2 = sha256.Sum256(bto.RawInfo)
+	tf.MetaVersion = 2
+
+	if len(bto.Info.FileTree) == 0 {
+		return fmt.Errorf("missing file tree")
+	}
+	var files []v2File
+	if err := parseFileTree(bto.Info.FileTree, nil, &files); err != nil {
+		return err
+	}
+
+	layers, err := parsePieceLayers(bto.PieceLayers, files, pieceLen)
+	if err != nil {
+		return err
+	}
+	tf.PieceLayers = layers
+
+	hybrid := len(tf.PieceHashes) > 0
+	if hybrid {
+		if err := checkHybridLayout(tf.Files, files, pieceLen); err != nil {
+			return err
+		}
+	} else {
+		copy(tf.InfoHash[:], tf.InfoHashV2[:20])
+		tf.Files, tf.Length = alignedLayout(files, pieceLen)
+		tf.MultiFile = len(files) != 1 || path.Join(files[0].Path...) != bto.Info.Name
+		if !tf.MultiFile {
+			tf.Files[0].Path = bto.Info.Name
+		}
+	}
+
+	tf.PieceRootsV2 = pieceRoots(files, layers, pieceLen, (tf.Length+pieceLen-1)/pieceLen)
+	return nil
+}
+
+// parsePieceLayers decodes the piece layers and checks each against its pieces root
+func parsePieceLayers(dict map[string]string, files []v2File, pieceLen int) (map[[32]byte][][32]byte, error) {
+	layers := make(map[[32]byte][][32]byte)
+	for _, f := range files {
+		if f.Length <= pieceLen {
+			continue
+		}
+		value, ok := dict[string(f.PiecesRoot[:])]
+		numPieces := (f.Length + pieceLen - 1) / pieceLen
+		if !ok || len(value) != 32*numPieces {
+			return nil, fmt.Errorf("missing or malformed piece layer for %v", f.Path)
+		}
+		layer := make([][32]byte, numPieces)
+		for i := range layer {
+			copy(layer[i][:], value[32*i:])
+		}
+		pad := merkle.PadHash(pieceLen / merkle.BlockSize)
+		if merkle.Root(layer, merkle.NextPow2(numPieces), pad) != f.PiecesRoot {
+			return nil, fmt.Errorf("piece layer for %v does not match its pieces root", f.Path)
+		}
+		layers[f.PiecesRoot] = layer
+	}
+	return layers, nil
+}
+
+// alignedLayout places each v2 file at a piece boundary, inserting pad files
+func alignedLayout(files []v2File, pieceLen int) ([]File, int) {
+	var out []File
+	offset := 0
+	for i, f := range files {
+		out = append(out, File{Path: path.Join(f.Path...), Length: f.Length})
+		offset += f.Length
+		if rem := offset % pieceLen; rem != 0 && i < len(files)-1 {
+			padLen := pieceLen - rem
+			out = append(out, File{Path: ".pad/" + strconv.Itoa(padLen), Length: padLen, Pad: true})
+			offset += padLen
+		}
+	}
+	return out, offset
+}
+
+// checkHybridLayout verifies the v1 files match the v2 file tree and that
+// every file starts on a piece boundary
+func checkHybridLayout(v1 []File, v2 []v2File, pieceLen int) error {
+	i, offset := 0, 0
+	for _, f := range v1 {
+		if !f.Pad {
+			if i >= len(v2) || f.Length != v2[i].Length || f.Path != path.Join(v2[i].Path...) {
+				return fmt.Errorf("hybrid torrent v1 file %q does not match the v2 file tree", f.Path)
+			}
+			if f.Length > 0 && offset%pieceLen != 0 {
+				return fmt.Errorf("hybrid torrent file %q is not piece aligned", f.Path)
+			}
+			i++
+		}
+		offset += f.Length
+	}
+	if i != len(v2) {
+		return fmt.Errorf("hybrid torrent has %d v1 files but %d v2 files", i, len(v2))
+	}
+	return nil
+}
+
+// pieceRoots computes the expected merkle root of every piece. Files are
+// piece aligned, so each piece holds data of at most one file.
+func pieceRoots(files []v2File, layers map[[32]byte][][32]byte, pieceLen, numPieces int) []download.PieceRootV2 {
+	roots := make([]download.PieceRootV2, numPieces)
+	index := 0
+	for _, f := range files {
+		if f.Length == 0 {
+			continue
+		}
+		if f.Length <= pieceLen {
+			blocks := (f.Length + merkle.BlockSize - 1) / merkle.BlockSize
+			roots[index] = download.PieceRootV2{Root: f.PiecesRoot, Leaves: merkle.NextPow2(blocks), Length: f.Length}
+			index++
+			continue
+		}
+		for j, root := range layers[f.PiecesRoot] {
+			length := min(pieceLen, f.Length-j*pieceLen)
+			roots[index] = download.PieceRootV2{Root: root, Leaves: pieceLen / merkle.BlockSize, Length: length}
+			index++
+		}
+	}
+	return roots
+}
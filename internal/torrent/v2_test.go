@@ -0,0 +1,237 @@
+package torrent
+
+import (
+	"btc/internal/bencode"
+	"btc/internal/download"
+	"btc/internal/merkle"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testPieceLen = 32 * 1024
+
+type testFile struct {
+	path string
+	data []byte
+}
+
+var testFiles = []testFile{
+	{"a.bin", bytes.Repeat([]byte{1}, 20000)},
+	{"b/c.bin", bytes.Repeat([]byte{2}, 70000)},
+	{"d.bin", bytes.Repeat([]byte{3}, 5)},
+}
+
+// piecesRoot returns a file's BEP 52 pieces root and, for files longer
+// than a piece, its piece layer
+func piecesRoot(data []byte) (merkle.Hash, []merkle.Hash) {
+	if len(data) <= testPieceLen {
+		blocks := (len(data) + merkle.BlockSize - 1) / merkle.BlockSize
+		return merkle.PieceRoot(data, merkle.NextPow2(blocks)), nil
+	}
+	var layer []merkle.Hash
+	for begin := 0; begin < len(data); begin += testPieceLen {
+		layer = append(layer, merkle.PieceRoot(data[begin:min(begin+testPieceLen, len(data))], testPieceLen/merkle.BlockSize))
+	}
+	pad := merkle.PadHash(testPieceLen / merkle.BlockSize)
+	return merkle.Root(layer, merkle.NextPow2(len(layer)), pad), layer
+}
+
+// buildTorrent writes a v2 or hybrid torrent of files, letting edit change
+// the v1 file list of a hybrid one, and returns its path
+func buildTorrent(t *testing.T, files []testFile, hybrid bool, edit func(v1 []map[string]any) []map[string]any) string {
+	t.Helper()
+	tree := map[string]any{}
+	layers := map[string]string{}
+	var v1 []map[string]any
+	var content []byte
+	for i, f := range files {
+		root, layer := piecesRoot(f.data)
+		node := tree
+		parts := strings.Split(f.path, "/")
+		for _, dir := range parts[:len(parts)-1] {
+			if node[dir] == nil {
+				node[dir] = map[string]any{}
+			}
+			node = node[dir].(map[string]any)
+		}
+		node[parts[len(parts)-1]] = map[string]any{"": map[string]any{"length": len(f.data), "pieces root": string(root[:])}}
+		if layer != nil {
+			var b []byte
+			for _, h := range layer {
+				b = append(b, h[:]...)
+			}
+			layers[string(root[:])] = string(b)
+		}
+
+		v1 = append(v1, map[string]any{"length": len(f.data), "path": parts})
+		content = append(content, f.data...)
+		if rem := len(content) % testPieceLen; rem != 0 && i < len(files)-1 {
+			padLen := testPieceLen - rem
+			v1 = append(v1, map[string]any{"length": padLen, "path": []string{".pad", strconv.Itoa(padLen)}, "attr": "p"})
+			content = append(content, make([]byte, padLen)...)
+		}
+	}
+
+	info := map[string]any{
+		"name":         "x",
+		"piece length": testPieceLen,
+		"meta version": 2,
+		"file tree":    tree,
+	}
+	if hybrid {
+		var pieces []byte
+		for begin := 0; begin < len(content); begin += testPieceLen {
+			h := sha1.Sum(content[begin:min(begin+testPieceLen, len(content))])
+			pieces = append(pieces, h[:]...)
+		}
+		if edit != nil {
+			v1 = edit(v1)
+		}
+		info["files"] = v1
+		info["pieces"] = string(pieces)
+	}
+	data, err := bencode.Marshal(map[string]any{
+		"announce":     "http://tracker.example/announce",
+		"info":         info,
+		"piece layers": layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "x.torrent")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenHybrid(t *testing.T) {
+	tf, err := Open(buildTorrent(t, testFiles, true, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tf.IsHybrid() {
+		t.Error("hybrid torrent not reported as hybrid")
+	}
+	if tf.InfoHash != sha1.Sum(tf.RawInfo) || tf.InfoHashV2 != sha256.Sum256(tf.RawInfo) {
+		t.Error("info hashes are not those of the info dictionary")
+	}
+	// a.bin and c.bin are padded to 32 KiB and 96 KiB
+	if tf.Length != 32768+98304+5 || tf.NumPieces() != 5 || len(tf.PieceRootsV2) != 5 {
+		t.Fatalf("length %d with %d pieces and %d v2 roots", tf.Length, tf.NumPieces(), len(tf.PieceRootsV2))
+	}
+
+	aRoot, _ := piecesRoot(testFiles[0].data)
+	_, cLayer := piecesRoot(testFiles[1].data)
+	dRoot, _ := piecesRoot(testFiles[2].data)
+	want := []download.PieceRootV2{
+		{Root: aRoot, Leaves: 2, Length: 20000},
+		{Root: cLayer[0], Leaves: 2, Length: testPieceLen},
+		{Root: cLayer[1], Leaves: 2, Length: testPieceLen},
+		{Root: cLayer[2], Leaves: 2, Length: 70000 - 2*testPieceLen},
+		{Root: dRoot, Leaves: 1, Length: 5},
+	}
+	for i, w := range want {
+		if tf.PieceRootsV2[i] != w {
+			t.Errorf("piece %d root %+v, want %+v", i, tf.PieceRootsV2[i], w)
+		}
+	}
+}
+
+func TestOpenV2Only(t *testing.T) {
+	tf, err := Open(buildTorrent(t, testFiles, false, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.IsHybrid() || len(tf.PieceHashes) != 0 {
+		t.Error("v2-only torrent reported as hybrid")
+	}
+	v2 := sha256.Sum256(tf.RawInfo)
+	if !bytes.Equal(tf.InfoHash[:], v2[:20]) {
+		t.Error("v2-only torrent does not use the truncated v2 info hash")
+	}
+	var paths []string
+	for _, f := range tf.Files {
+		paths = append(paths, f.Path)
+	}
+	if got := strings.Join(paths, " "); got != "a.bin .pad/12768 b/c.bin .pad/28304 d.bin" {
+		t.Errorf("aligned files %s", got)
+	}
+	if !tf.MultiFile || tf.Length != 32768+98304+5 {
+		t.Errorf("multi file %v, length %d", tf.MultiFile, tf.Length)
+	}
+}
+
+func TestOpenHybridLayoutMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(v1 []map[string]any) []map[string]any
+	}{
+		{"renamed file", func(v1 []map[string]any) []map[string]any {
+			v1[0]["path"] = []string{"z.bin"}
+			return v1
+		}},
+		{"different length", func(v1 []map[string]any) []map[string]any {
+			v1[2]["length"] = 69999
+			return v1
+		}},
+		{"missing pad file", func(v1 []map[string]any) []map[string]any {
+			return append(v1[:1:1], v1[2:]...)
+		}},
+		{"missing file", func(v1 []map[string]any) []map[string]any {
+			return v1[:len(v1)-1]
+		}},
+		{"extra file", func(v1 []map[string]any) []map[string]any {
+			return append(v1, map[string]any{"length": 1, "path": []string{"e.bin"}})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(buildTorrent(t, testFiles, true, tt.edit)); err == nil {
+				t.Error("mismatched hybrid torrent opened")
+			}
+		})
+	}
+}
+
+func TestCheckHybridLayout(t *testing.T) {
+	v2 := []v2File{{Path: []string{"a"}, Length: 10}, {Path: []string{"b"}, Length: 0}, {Path: []string{"c"}, Length: 20}}
+	tests := []struct {
+		name    string
+		v1      []File
+		wantErr bool
+	}{
+		{"aligned", []File{{Path: "a", Length: 10}, {Path: ".pad/6", Length: 6, Pad: true}, {Path: "b"}, {Path: "c", Length: 20}}, false},
+		{"unaligned", []File{{Path: "a", Length: 10}, {Path: "b"}, {Path: "c", Length: 20}}, true},
+		{"short pad", []File{{Path: "a", Length: 10}, {Path: ".pad/5", Length: 5, Pad: true}, {Path: "b"}, {Path: "c", Length: 20}}, true},
+		{"reordered", []File{{Path: "c", Length: 20}, {Path: ".pad/12", Length: 12, Pad: true}, {Path: "b"}, {Path: "a", Length: 10}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkHybridLayout(tt.v1, v2, 16)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkHybridLayout = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenBadPieceLayer(t *testing.T) {
+	path := buildTorrent(t, testFiles, false, nil)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte inside the piece layers value, which comes last
+	data[len(data)-10] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+	if _, err := Open(path); err == nil {
+		t.Error("torrent with a corrupt piece layer opened")
+	}
+}
@@ -1,26 +1,41 @@
 package tracker
 
 import (
+	"btc/internal/bencode"
 	"btc/internal/config"
+	"btc/internal/logger"
 	"btc/internal/peer"
+	"btc/internal/proxy"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
-
-	"github.com/jackpal/bencode-go"
+	"sync"
+	"time"
 )
 
 // bencodeTrackerResp holds the tracker response
 type bencodeTrackerResp struct {
-	Peers    string `bencode:"peers"`
-	Interval int    `bencode:"interval"`
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Peers          string `bencode:"peers"`
+	Interval       int    `bencode:"interval"`
+	MinInterval    int    `bencode:"min interval"`
+	TrackerID      string `bencode:"tracker id"`
+	Complete       int    `bencode:"complete"`
+	Incomplete     int    `bencode:"incomplete"`
 }
 
+// maxResponseSize bounds any single string in a tracker response
+const maxResponseSize = 4 << 20
+
 // HTTPTracker implements the Tracker interface for HTTP/HTTPS trackers
 type HTTPTracker struct {
 	AnnounceURL string
 	Cfg         *config.Config
+
+	mu        sync.Mutex
+	trackerID string // echoed back once the tracker has sent one
 }
 
 // NewHTTPTracker creates a new HTTP tracker client
@@ -31,35 +46,63 @@ func NewHTTPTracker(announceURL string, cfg *config.Config) *HTTPTracker {
 	}
 }
 
-// BuildURL constructs the announce URL with required parameters
-func (t *HTTPTracker) BuildURL(peerID [20]byte, port uint16, infoHash [20]byte, left int) (string, error) {
+// BuildURL constructs the announce URL for req, keeping any parameters
+// such as a passkey already present in the announce URL
+func (t *HTTPTracker) BuildURL(req *AnnounceRequest) (string, error) {
 	parsedURL, err := url.Parse(t.AnnounceURL)
 	if err != nil {
 		return "", fmt.Errorf("parsing tracker URL: %w", err)
 	}
 
-	params := url.Values{
-		"info_hash":  []string{string(infoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(left)}, 
+	params := parsedURL.Query()
+	params.Set("info_hash", string(req.InfoHash[:]))
+	params.Set("peer_id", string(req.PeerID[:]))
+	params.Set("port", strconv.Itoa(int(req.Port)))
+	params.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	params.Set("left", strconv.FormatInt(req.Left, 10))
+	params.Set("corrupt", strconv.FormatInt(req.Corrupt, 10))
+	params.Set("redundant", strconv.FormatInt(req.Redundant, 10))
+	params.Set("compact", "1")
+	params.Set("no_peer_id", "1")
+	params.Set("key", fmt.Sprintf("%08x", req.Key))
+	if req.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.Event != "" {
+		params.Set("event", req.Event)
+	}
+	if req.IP != "" {
+		params.Set("ip", req.IP)
 	}
+	if req.IPv4 != "" {
+		params.Set("ipv4", req.IPv4)
+	}
+	if req.IPv6 != "" {
+		params.Set("ipv6", req.IPv6)
+	}
+	t.mu.Lock()
+	if t.trackerID != "" {
+		params.Set("trackerid", t.trackerID)
+	}
+	t.mu.Unlock()
 	parsedURL.RawQuery = params.Encode()
 
 	return parsedURL.String(), nil
 }
 
-// Announce contacts the tracker and returns a list of peers
-func (t *HTTPTracker) Announce(peerID [20]byte, port uint16, infoHash [20]byte, left int) ([]peer.Peer, error) {
-	announceURL, err := t.BuildURL(peerID, port, infoHash, left)
+// Announce contacts the tracker and returns its peers and swarm counts.
+// A rejection by the tracker is returned as a *FailureError.
+func (t *HTTPTracker) Announce(req *AnnounceRequest) (*AnnounceResponse, error) {
+	announceURL, err := t.BuildURL(req)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{Timeout: t.Cfg.TrackerTimeout}
+	client, err := proxy.HTTPClient(t.Cfg, proxy.Trackers, t.Cfg.TrackerTimeout)
+	if err != nil {
+		return nil, err
+	}
 	resp, err := client.Get(announceURL)
 	if err != nil {
 		return nil, fmt.Errorf("contacting tracker: %w", err)
@@ -71,12 +114,36 @@ func (t *HTTPTracker) Announce(peerID [20]byte, port uint16, infoHash [20]byte,
 	}
 
 	var trackerResp bencodeTrackerResp
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+	decoder := bencode.NewDecoder(resp.Body)
+	decoder.SetLimits(16, maxResponseSize)
+	err = decoder.Decode(&trackerResp)
 	if err != nil {
 		return nil, fmt.Errorf("parsing tracker response: %w", err)
 	}
+	if trackerResp.FailureReason != "" {
+		return nil, &FailureError{Reason: trackerResp.FailureReason}
+	}
+	if trackerResp.WarningMessage != "" {
+		logger.Warn("tracker warning", "tracker", t.AnnounceURL, "message", trackerResp.WarningMessage)
+	}
+	if trackerResp.TrackerID != "" {
+		t.mu.Lock()
+		t.trackerID = trackerResp.TrackerID
+		t.mu.Unlock()
+	}
 
-	return peer.UnmarshalPeers([]byte(trackerResp.Peers))
+	peers, err := peer.UnmarshalPeers([]byte(trackerResp.Peers))
+	if err != nil {
+		return nil, err
+	}
+	return &AnnounceResponse{
+		Peers:       peers,
+		Interval:    time.Duration(trackerResp.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+		Seeders:     trackerResp.Complete,
+		Leechers:    trackerResp.Incomplete,
+		Warning:     trackerResp.WarningMessage,
+	}, nil
 }
 
 // Ensure HTTPTracker implements Tracker interface
@@ -1,10 +1,63 @@
 package tracker
 
-import "btc/internal/peer"
+import (
+	"btc/internal/peer"
+	"time"
+)
 
 // Tracker defines the interface for tracker communication.
 // This allows swapping between HTTP and UDP tracker implementations.
 type Tracker interface {
 	// Announce contacts the tracker and returns a list of peers
-	Announce(peerID [20]byte, port uint16, infoHash [20]byte, left int) ([]peer.Peer, error)
+	Announce(req *AnnounceRequest) (*AnnounceResponse, error)
+}
+
+// Announce events
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// AnnounceRequest holds the parameters of an announce
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Corrupt    int64 // bytes of pieces that failed the hash check
+	Redundant  int64 // bytes received more than once
+	Event      string
+	NumWant    int    // peers wanted, the tracker default when zero
+	Key        uint32 // stays the same across announces so the tracker can tell us apart from our IP changing
+	// IP, IPv4 and IPv6 are addresses to report instead of the one the
+	// tracker sees, sent only when set
+	IP   string
+	IPv4 string
+	IPv6 string
+}
+
+// AnnounceResponse is a successful announce
+type AnnounceResponse struct {
+	Peers []peer.Peer
+	// Interval is how long to wait before announcing again, MinInterval
+	// the least the tracker accepts. Either is zero when not given.
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+	Warning     string // shown to the user, the announce still succeeded
+}
+
+// FailureError is a tracker's refusal of an announce, carrying its
+// human readable failure reason
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return "tracker failure: " + e.Reason
 }
@@ -0,0 +1,132 @@
+package tracker
+
+import (
+	"btc/internal/bencode"
+	"btc/internal/config"
+	"btc/internal/proxy"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrScrapeUnsupported is returned for HTTP trackers whose announce URL does
+// not follow the scrape convention (BEP 48)
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// SwarmStats are the counts a tracker reports for one torrent
+type SwarmStats struct {
+	Seeders    int // peers with the complete torrent
+	Leechers   int // peers still downloading
+	Downloaded int // times the torrent was completed
+}
+
+// Scraper is implemented by trackers that report swarm stats
+type Scraper interface {
+	// Scrape returns stats for each of the info hashes the tracker knows
+	Scrape(infoHashes [][20]byte) (map[[20]byte]SwarmStats, error)
+}
+
+// NewScraper returns a scraper for an http(s) or udp announce URL
+func NewScraper(announceURL string, cfg *config.Config) (Scraper, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing tracker URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPTracker(announceURL, cfg), nil
+	case "udp":
+		return NewUDPTracker(announceURL, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// ScrapeURL derives the scrape URL from an HTTP announce URL by replacing
+// "announce" at the start of the last path segment with "scrape"
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing tracker URL: %w", err)
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	last := u.Path[slash+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	return u.String(), nil
+}
+
+// bencodeScrapeFile is the per torrent entry of a scrape response
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// bencodeScrapeResp is keyed by the raw 20 byte info hash
+type bencodeScrapeResp struct {
+	Files         map[string]bencodeScrapeFile `bencode:"files"`
+	FailureReason string                       `bencode:"failure reason"`
+}
+
+// Scrape asks the tracker for swarm stats of all infoHashes in one request
+func (t *HTTPTracker) Scrape(infoHashes [][20]byte) (map[[20]byte]SwarmStats, error) {
+	scrapeURL, err := ScrapeURL(t.AnnounceURL)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(scrapeURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing scrape URL: %w", err)
+	}
+	// Keep any passkey or other parameters of the announce URL
+	params := u.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	client, err := proxy.HTTPClient(t.Cfg, proxy.Trackers, t.Cfg.TrackerTimeout)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("contacting tracker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker returned status %d", resp.StatusCode)
+	}
+
+	var scrapeResp bencodeScrapeResp
+	decoder := bencode.NewDecoder(resp.Body)
+	decoder.SetLimits(16, maxResponseSize)
+	err = decoder.Decode(&scrapeResp)
+	if err != nil {
+		return nil, fmt.Errorf("parsing scrape response: %w", err)
+	}
+	if scrapeResp.FailureReason != "" {
+		return nil, fmt.Errorf("scrape failed: %s", scrapeResp.FailureReason)
+	}
+
+	stats := make(map[[20]byte]SwarmStats, len(scrapeResp.Files))
+	for key, f := range scrapeResp.Files {
+		if len(key) != 20 {
+			continue
+		}
+		stats[[20]byte([]byte(key))] = SwarmStats{Seeders: f.Complete, Leechers: f.Incomplete, Downloaded: f.Downloaded}
+	}
+	return stats, nil
+}
+
+// Ensure both tracker kinds implement Scraper
+var (
+	_ Scraper = (*HTTPTracker)(nil)
+	_ Scraper = (*UDPTracker)(nil)
+)
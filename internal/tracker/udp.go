@@ -0,0 +1,166 @@
+package tracker
+
+import (
+	"btc/internal/config"
+	"btc/internal/proxy"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect = 0
+	udpActionScrape  = 2
+	udpActionError   = 3
+
+	// maxScrapeHashes is how many info hashes fit in one scrape packet
+	maxScrapeHashes = 74
+	// connectionIDLifetime is how long a connection ID may be reused
+	connectionIDLifetime = time.Minute
+	udpRetryTimeout      = 15 * time.Second
+)
+
+// UDPTracker talks to a udp:// tracker
+type UDPTracker struct {
+	Addr string
+	Cfg  *config.Config
+
+	mu        sync.Mutex
+	connID    uint64
+	connIDAge time.Time
+}
+
+// NewUDPTracker creates a client for a udp://host:port announce URL
+func NewUDPTracker(announceURL string, cfg *config.Config) (*UDPTracker, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing tracker URL: %w", err)
+	}
+	if u.Scheme != "udp" || u.Port() == "" {
+		return nil, fmt.Errorf("invalid udp tracker URL %q", announceURL)
+	}
+	return &UDPTracker{Addr: u.Host, Cfg: cfg}, nil
+}
+
+// Scrape asks the tracker for swarm stats, batching the info hashes into as
+// few packets as the protocol allows
+func (t *UDPTracker) Scrape(infoHashes [][20]byte) (map[[20]byte]SwarmStats, error) {
+	conn, err := proxy.DialUDP(t.Cfg, proxy.Trackers, t.Addr, t.Cfg.TrackerTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("contacting tracker: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(t.Cfg.TrackerTimeout)
+
+	stats := make(map[[20]byte]SwarmStats, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += maxScrapeHashes {
+		batch := infoHashes[start:min(start+maxScrapeHashes, len(infoHashes))]
+		connID, err := t.connect(conn, deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		req := make([]byte, 16, 16+20*len(batch))
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+		for _, h := range batch {
+			req = append(req, h[:]...)
+		}
+		resp, err := roundTrip(conn, req, udpActionScrape, 8+12*len(batch), deadline)
+		if err != nil {
+			return nil, fmt.Errorf("scraping tracker: %w", err)
+		}
+		for i, h := range batch {
+			entry := resp[8+12*i:]
+			stats[h] = SwarmStats{
+				Seeders:    int(binary.BigEndian.Uint32(entry[0:4])),
+				Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+				Leechers:   int(binary.BigEndian.Uint32(entry[8:12])),
+			}
+		}
+	}
+	return stats, nil
+}
+
+// connect returns a connection ID, reusing the last one while it is valid
+func (t *UDPTracker) connect(conn net.Conn, deadline time.Time) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.connID != 0 && time.Since(t.connIDAge) < connectionIDLifetime {
+		return t.connID, nil
+	}
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	resp, err := roundTrip(conn, req, udpActionConnect, 16, deadline)
+	if err != nil {
+		return 0, fmt.Errorf("connecting to tracker: %w", err)
+	}
+	t.connID = binary.BigEndian.Uint64(resp[8:16])
+	t.connIDAge = time.Now()
+	return t.connID, nil
+}
+
+// roundTrip fills in a fresh transaction ID at req[12:16], sends req and
+// waits for the matching response of at least minLen bytes. Lost packets
+// are retried with the timeout doubling each time, until deadline.
+func roundTrip(conn net.Conn, req []byte, action uint32, minLen int, deadline time.Time) ([]byte, error) {
+	if _, err := rand.Read(req[12:16]); err != nil {
+		return nil, err
+	}
+	txID := req[12:16]
+
+	buf := make([]byte, 2048)
+	timeout := udpRetryTimeout
+	for {
+		if time.Now().After(deadline) {
+			return nil, errors.New("tracker did not respond")
+		}
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(minTime(time.Now().Add(timeout), deadline))
+		timeout *= 2
+
+		for {
+			n, err := conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			resp := buf[:n]
+			if n < 8 || !bytes.Equal(resp[4:8], txID) {
+				continue // stale or unrelated packet
+			}
+			switch got := binary.BigEndian.Uint32(resp[0:4]); {
+			case got == udpActionError:
+				return nil, fmt.Errorf("tracker error: %s", resp[8:])
+			case got != action:
+				return nil, fmt.Errorf("unexpected action %d in response", got)
+			case n < minLen:
+				return nil, fmt.Errorf("short response: %d bytes", n)
+			}
+			return resp, nil
+		}
+	}
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,48 @@
+// Package version identifies this client to trackers and peers.
+package version
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Version is the client version, overridden at build time with
+// -ldflags "-X btc/internal/version.Version=1.2.3"
+var Version = "0.1.0"
+
+// Name is the client name reported to peers
+const Name = "bitorrent"
+
+// ClientCode is our two letter client code in Azureus style peer IDs. It
+// is not registered to any other client, "BT" belongs to mainline
+// BitTorrent.
+const ClientCode = "bR"
+
+// PeerIDPrefix returns the Azureus style peer ID prefix, such as -bR0100-
+// for version 0.1.0. Each of the four version parts is one character,
+// 0-9 then A-Z for 10 to 35.
+func PeerIDPrefix() string {
+	digits := []byte("0000")
+	parts := strings.SplitN(strings.TrimPrefix(Version, "v"), ".", 4)
+	for i, part := range parts {
+		// Ignore suffixes like "-rc1"
+		end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if end >= 0 {
+			part = part[:end]
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 35 {
+			continue
+		}
+		digits[i] = strconv.FormatInt(int64(n), 36)[0]
+		if digits[i] >= 'a' {
+			digits[i] -= 'a' - 'A'
+		}
+	}
+	return "-" + ClientCode + string(digits) + "-"
+}
+
+// String returns the name and version, as sent in the BEP 10 handshake
+func String() string {
+	return Name + " " + Version
+}
@@ -0,0 +1,187 @@
+package webseed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind distinguishes the two web seed protocols
+type Kind int
+
+const (
+	// GetRight is a BEP 19 url-list seed serving the plain files
+	GetRight Kind = iota
+	// Hoffman is a BEP 17 httpseeds script serving pieces by index
+	Hoffman
+)
+
+// File is a file of the torrent content, with a slash separated path.
+// Pad files are not served by mirrors and read as zeros.
+type File struct {
+	Path   string
+	Length int64
+	Pad    bool
+}
+
+// Seed fetches torrent data from an HTTP mirror
+type Seed struct {
+	URL       string
+	Kind      Kind
+	name      string
+	files     []File
+	multiFile bool
+	pieceLen  int64
+	infoHash  [20]byte
+	client    *http.Client
+}
+
+// RetryError is returned when a seed asks to be retried later (BEP 17 503)
+type RetryError struct {
+	After time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("web seed busy, retry after %s", e.After)
+}
+
+// New creates a web seed for the torrent with the given layout, fetching
+// with client
+func New(rawURL string, kind Kind, name string, files []File, multiFile bool, pieceLen int, infoHash [20]byte, client *http.Client) *Seed {
+	return &Seed{
+		URL:       rawURL,
+		Kind:      kind,
+		name:      name,
+		files:     files,
+		multiFile: multiFile,
+		pieceLen:  int64(pieceLen),
+		infoHash:  infoHash,
+		client:    client,
+	}
+}
+
+// FetchPiece downloads length bytes of piece index
+func (s *Seed) FetchPiece(ctx context.Context, index, length int) ([]byte, error) {
+	if s.Kind == Hoffman {
+		return s.fetchHoffman(ctx, index, length)
+	}
+
+	buf := make([]byte, length)
+	offset := int64(index) * s.pieceLen
+	pos := 0
+	var fileOffset int64
+	for _, f := range s.files {
+		end := fileOffset + f.Length
+		if pos < length && offset+int64(pos) < end && f.Length > 0 {
+			start := offset + int64(pos) - fileOffset
+			n := int(min(int64(length-pos), f.Length-start))
+			if !f.Pad {
+				if err := s.fetchRange(ctx, s.fileURL(f), start, buf[pos:pos+n]); err != nil {
+					return nil, err
+				}
+			}
+			pos += n
+		}
+		fileOffset = end
+	}
+	if pos != length {
+		return nil, fmt.Errorf("piece %d extends past the torrent content", index)
+	}
+	return buf, nil
+}
+
+// fileURL builds the BEP 19 URL for a file
+func (s *Seed) fileURL(f File) string {
+	if !s.multiFile {
+		if strings.HasSuffix(s.URL, "/") {
+			return s.URL + url.PathEscape(s.name)
+		}
+		return s.URL
+	}
+	base := s.URL
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	parts := append([]string{s.name}, strings.Split(f.Path, "/")...)
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// fetchRange fills buf with the bytes of fileURL starting at start
+func (s *Seed) fetchRange(ctx context.Context, fileURL string, start int64, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+int64(len(buf))-1))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("contacting web seed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Server ignored the range, skip to the part we asked for
+		if _, err := io.CopyN(io.Discard, resp.Body, start); err != nil {
+			return fmt.Errorf("reading web seed response: %w", err)
+		}
+	default:
+		return fmt.Errorf("web seed returned status %d", resp.StatusCode)
+	}
+
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return fmt.Errorf("reading web seed response: %w", err)
+	}
+	return nil
+}
+
+// fetchHoffman requests a whole piece from a BEP 17 seed
+func (s *Seed) fetchHoffman(ctx context.Context, index, length int) ([]byte, error) {
+	parsedURL, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing web seed URL: %w", err)
+	}
+	params := parsedURL.Query()
+	params.Set("info_hash", string(s.infoHash[:]))
+	params.Set("piece", strconv.Itoa(index))
+	parsedURL.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsedURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("contacting web seed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		// The body holds the number of seconds to wait
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+		seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil {
+			seconds = 60
+		}
+		return nil, &RetryError{After: time.Duration(seconds) * time.Second}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("web seed returned status %d", resp.StatusCode)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return nil, fmt.Errorf("reading web seed response: %w", err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,132 @@
+package webseed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestFetchPieceAcrossFiles(t *testing.T) {
+	// Piece 1 covers the end of a.bin, the pad file and the start of d/b.bin
+	data := testData(100)
+	a, b := data[:30], data[40:]
+	var ranges []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/m/x/a.bin", func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, "a "+r.Header.Get("Range"))
+		http.ServeContent(w, r, "a.bin", time.Time{}, bytes.NewReader(a))
+	})
+	mux.HandleFunc("/m/x/d/b%20c.bin", func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, "b "+r.Header.Get("Range"))
+		http.ServeContent(w, r, "b c.bin", time.Time{}, bytes.NewReader(b))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	files := []File{
+		{Path: "a.bin", Length: 30},
+		{Path: ".pad/10", Length: 10, Pad: true},
+		{Path: "d/b c.bin", Length: 60},
+	}
+	seed := New(srv.URL+"/m", GetRight, "x", files, true, 25, [20]byte{}, srv.Client())
+	got, err := seed.FetchPiece(context.Background(), 1, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte{}, data[25:30]...), make([]byte, 10)...), data[40:50]...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("piece 1 = %v, want %v", got, want)
+	}
+	wantRanges := []string{"a bytes=25-29", "b bytes=0-9"}
+	if len(ranges) != len(wantRanges) || ranges[0] != wantRanges[0] || ranges[1] != wantRanges[1] {
+		t.Errorf("requested ranges %q, want %q", ranges, wantRanges)
+	}
+
+	if _, err := seed.FetchPiece(context.Background(), 4, 25); err == nil {
+		t.Error("fetching a piece past the content succeeded")
+	}
+}
+
+func TestFetchPieceIgnoredRange(t *testing.T) {
+	// A server without range support sends the whole file
+	data := testData(64)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	files := []File{{Path: "x", Length: 64}}
+	seed := New(srv.URL+"/x", GetRight, "x", files, false, 16, [20]byte{}, srv.Client())
+	got, err := seed.FetchPiece(context.Background(), 2, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[32:48]) {
+		t.Errorf("piece 2 = %v, want %v", got, data[32:48])
+	}
+}
+
+func TestFetchPieceStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	files := []File{{Path: "x", Length: 64}}
+	for _, kind := range []Kind{GetRight, Hoffman} {
+		seed := New(srv.URL+"/", kind, "x", files, false, 16, [20]byte{}, srv.Client())
+		if _, err := seed.FetchPiece(context.Background(), 0, 16); err == nil {
+			t.Errorf("kind %d: fetching from a failing server succeeded", kind)
+		}
+	}
+}
+
+func TestFetchHoffman(t *testing.T) {
+	data := testData(64)
+	infoHash := [20]byte{1, 2, 3, '&', '='}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("info_hash") != string(infoHash[:]) || q.Get("key") != "v" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		switch q.Get("piece") {
+		case "1":
+			w.Write(data[16:32])
+		case "2":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("7\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	files := []File{{Path: "x", Length: 64}}
+	seed := New(srv.URL+"/seed?key=v", Hoffman, "x", files, false, 16, infoHash, srv.Client())
+	got, err := seed.FetchPiece(context.Background(), 1, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[16:32]) {
+		t.Errorf("piece 1 = %v, want %v", got, data[16:32])
+	}
+
+	_, err = seed.FetchPiece(context.Background(), 2, 16)
+	var retry *RetryError
+	if !errors.As(err, &retry) || retry.After != 7*time.Second {
+		t.Errorf("busy seed returned %v, want a retry after 7s", err)
+	}
+}